@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// name under which the address book is stored on the server
+const addressBookBlob = "addressbook"
+
+// bookEntry is a single contact in the client's address book.
+type bookEntry struct {
+	Alias       string
+	Nick        string
+	Notes       string `json:",omitempty"`
+	Fingerprint string `json:",omitempty"`
+}
+
+// addressBook is the client's local list of contacts, keyed by alias.  It is
+// only ever written to disk or sent to the server encrypted with the user's
+// key.
+type addressBook struct {
+	Updated time.Time
+	Entries map[string]*bookEntry
+}
+
+func newAddressBook() *addressBook {
+	return &addressBook{Entries: make(map[string]*bookEntry, 8)}
+}
+
+// resolve maps an alias to a nick.  Names that aren't aliases are assumed to
+// be nicks already.
+func (b *addressBook) resolve(name string) string {
+	if e, ok := b.Entries[name]; ok {
+		return e.Nick
+	}
+	return name
+}
+
+// byNick finds the entries for a given nick.  A nick may have more than one
+// alias.
+func (b *addressBook) byNick(nick string) []*bookEntry {
+	var entries []*bookEntry
+	for _, e := range b.Entries {
+		if e.Nick == nick {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// aliases returns every alias in the book, sorted.
+func (b *addressBook) aliases() []string {
+	aliases := make([]string, 0, len(b.Entries))
+	for alias := range b.Entries {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+func (b *addressBook) touch() {
+	b.Updated = time.Now()
+}
+
+// EncryptedBlob is an opaque, client-encrypted value.  Key is an aes key
+// encrypted with the owner's rsa public key, and Data is the aes ciphertext.
+type EncryptedBlob struct {
+	Key  []byte
+	Data []byte
+}
+
+// StoreBlob saves an encrypted blob on the server under a name, replacing
+// any existing blob of the same name.
+type StoreBlob struct {
+	Name string
+	Blob EncryptedBlob
+}
+
+func (s StoreBlob) Kind() string {
+	return "store-blob"
+}
+
+func init() { registerRequestType(func() request { return new(StoreBlob) }) }
+
+type GetBlob struct {
+	Name string
+}
+
+func (g GetBlob) Kind() string {
+	return "get-blob"
+}
+
+func init() { registerRequestType(func() request { return new(GetBlob) }) }
+
+type BlobResponse struct {
+	Name  string
+	Found bool
+	Blob  EncryptedBlob
+}
+
+func (b BlobResponse) Kind() string {
+	return "blob"
+}
+
+func init() { registerRequestType(func() request { return new(BlobResponse) }) }
+
+func (c *Client) sealBlob(v interface{}) (*EncryptedBlob, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal blob: %v", err)
+	}
+	key, err := c.aesKey()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create blob key: %v", err)
+	}
+	data, err := c.aesEncrypt(key, raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt blob: %v", err)
+	}
+	ckey, err := rsa.EncryptPKCS1v15(rand.Reader, &c.key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt blob key: %v", err)
+	}
+	return &EncryptedBlob{Key: ckey, Data: data}, nil
+}
+
+func (c *Client) openBlob(blob *EncryptedBlob, v interface{}) error {
+	key, err := c.rsaDecrypt(blob.Key)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt blob key: %v", err)
+	}
+	raw, err := c.aesDecrypt(key, blob.Data)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt blob: %v", err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("unable to parse blob: %v", err)
+	}
+	return nil
+}
+
+// loadBook reads the encrypted address book from disk.  A missing file is
+// an empty book.
+func (c *Client) loadBook() error {
+	c.book = newAddressBook()
+	raw, err := ioutil.ReadFile(options.book)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read address book: %v", err)
+	}
+	var blob EncryptedBlob
+	if err := json.Unmarshal(raw, &blob); err != nil {
+		return fmt.Errorf("unable to parse address book file %s: %v", options.book, err)
+	}
+	book := newAddressBook()
+	if err := c.openBlob(&blob, book); err != nil {
+		return fmt.Errorf("unable to open address book: %v", err)
+	}
+	c.book = book
+	return nil
+}
+
+// saveBook writes the address book to disk and pushes it to the server.
+func (c *Client) saveBook() error {
+	c.book.touch()
+	blob, err := c.sealBlob(c.book)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(blob)
+	if err != nil {
+		return fmt.Errorf("unable to marshal address book: %v", err)
+	}
+	if err := ioutil.WriteFile(options.book, raw, 0600); err != nil {
+		return fmt.Errorf("unable to write address book: %v", err)
+	}
+	return c.pushBook(blob)
+}
+
+func (c *Client) pushBook(blob *EncryptedBlob) error {
+	p, err := c.sendRequest(StoreBlob{Name: addressBookBlob, Blob: *blob})
+	if err != nil {
+		return fmt.Errorf("unable to sync address book: %v", err)
+	}
+	switch v := (<-p).(type) {
+	case *Bool:
+		return nil
+	case *ErrorDoc:
+		return fmt.Errorf("unable to sync address book: %v", v.Error())
+	default:
+		return fmt.Errorf("received response of unexpected type: %T", v)
+	}
+}
+
+// syncBook reconciles the local address book with the copy on the server.
+// Whichever was updated most recently wins.
+func (c *Client) syncBook() error {
+	p, err := c.sendRequest(GetBlob{Name: addressBookBlob})
+	if err != nil {
+		return fmt.Errorf("unable to fetch address book: %v", err)
+	}
+	var res *BlobResponse
+	switch v := (<-p).(type) {
+	case *BlobResponse:
+		res = v
+	case *ErrorDoc:
+		return fmt.Errorf("unable to fetch address book: %v", v.Error())
+	default:
+		return fmt.Errorf("received response of unexpected type: %T", v)
+	}
+
+	if res.Found {
+		remote := newAddressBook()
+		if err := c.openBlob(&res.Blob, remote); err != nil {
+			return err
+		}
+		if !remote.Updated.Before(c.book.Updated) {
+			c.book = remote
+			raw, err := json.Marshal(res.Blob)
+			if err != nil {
+				return fmt.Errorf("unable to marshal address book: %v", err)
+			}
+			if err := ioutil.WriteFile(options.book, raw, 0600); err != nil {
+				return fmt.Errorf("unable to write address book: %v", err)
+			}
+			c.info("address book updated from server")
+			return nil
+		}
+	}
+	if len(c.book.Entries) == 0 {
+		return nil
+	}
+	blob, err := c.sealBlob(c.book)
+	if err != nil {
+		return err
+	}
+	return c.pushBook(blob)
+}
+
+// checkPin verifies a key received from the server against any fingerprint
+// pinned for that nick in the address book.
+func (c *Client) checkPin(nick string, key *rsa.PublicKey) error {
+	fp := keyFingerprint(key)
+	for _, e := range c.book.byNick(nick) {
+		if e.Fingerprint != "" && e.Fingerprint != fp {
+			return fmt.Errorf("key for %s has fingerprint %s but %s is pinned to %s", nick, fp, e.Alias, e.Fingerprint)
+		}
+	}
+	return nil
+}
+
+// complete performs tab completion of aliases for the commands that accept
+// them.
+func (c *Client) complete() {
+	line := string(c.line)
+	parts := strings.Split(line, " ")
+	if len(parts) != 2 {
+		return
+	}
+	switch parts[0] {
+	case "msg/send", "keys/get", "book/remove", "book/note", "book/pin":
+	default:
+		return
+	}
+
+	prefix := parts[1]
+	var matches []string
+	for _, alias := range c.book.aliases() {
+		if strings.HasPrefix(alias, prefix) {
+			matches = append(matches, alias)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return
+	case 1:
+		c.line = []rune(parts[0] + " " + matches[0] + " ")
+		c.renderLine()
+	default:
+		common := matches[0]
+		for _, m := range matches[1:] {
+			for !strings.HasPrefix(m, common) {
+				common = common[:len(common)-1]
+			}
+		}
+		c.line = []rune(parts[0] + " " + common)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.trunc()
+		fmt.Println(strings.Join(matches, "  "))
+		c.renderLine()
+	}
+}
+
+// ------------------------------------------------------------------------------
+// address book commands
+// ------------------------------------------------------------------------------
+
+func (c *Client) bookAdd(args []string) {
+	if len(args) != 2 {
+		c.err("book/add takes exactly two args: an alias and a nick")
+		return
+	}
+	alias, nick := args[0], args[1]
+	if e, ok := c.book.Entries[alias]; ok && e.Nick != nick {
+		c.err("alias %s already refers to %s", alias, e.Nick)
+		return
+	}
+	c.book.Entries[alias] = &bookEntry{Alias: alias, Nick: nick}
+	if err := c.saveBook(); err != nil {
+		c.err("%v", err)
+		return
+	}
+	c.renderLine()
+}
+
+func (c *Client) bookRemove(args []string) {
+	if len(args) != 1 {
+		c.err("book/remove takes exactly one arg: an alias")
+		return
+	}
+	if _, ok := c.book.Entries[args[0]]; !ok {
+		c.err("no such alias: %s", args[0])
+		return
+	}
+	delete(c.book.Entries, args[0])
+	if err := c.saveBook(); err != nil {
+		c.err("%v", err)
+		return
+	}
+	c.renderLine()
+}
+
+func (c *Client) bookNote(args []string) {
+	if len(args) < 1 {
+		c.err("book/note takes an alias followed by the note text")
+		return
+	}
+	e, ok := c.book.Entries[args[0]]
+	if !ok {
+		c.err("no such alias: %s", args[0])
+		return
+	}
+	e.Notes = strings.Join(args[1:], " ")
+	if err := c.saveBook(); err != nil {
+		c.err("%v", err)
+		return
+	}
+	c.renderLine()
+}
+
+func (c *Client) bookPin(args []string) {
+	if len(args) != 1 {
+		c.err("book/pin takes exactly one arg: an alias")
+		return
+	}
+	e, ok := c.book.Entries[args[0]]
+	if !ok {
+		c.err("no such alias: %s", args[0])
+		return
+	}
+	key, err := c.getKey(e.Nick)
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+	e.Fingerprint = keyFingerprint(key)
+	if err := c.saveBook(); err != nil {
+		c.err("%v", err)
+		return
+	}
+	c.info("pinned %s to %s", e.Alias, e.Fingerprint)
+	c.renderLine()
+}
+
+func (c *Client) bookList(args []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.trunc()
+	for _, alias := range c.book.aliases() {
+		e := c.book.Entries[alias]
+		fmt.Printf("%s\t%s", e.Alias, e.Nick)
+		if e.Fingerprint != "" {
+			fmt.Printf("\t\033[90m%s\033[0m", e.Fingerprint)
+		}
+		if e.Notes != "" {
+			fmt.Printf("\t%s", e.Notes)
+		}
+		fmt.Print("\n")
+	}
+	c.renderLine()
+}
+
+func (c *Client) bookSync(args []string) {
+	if err := c.syncBook(); err != nil {
+		c.err("%v", err)
+		return
+	}
+	c.renderLine()
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// The agent holds a private key in memory and uses it on behalf of other
+// whisper processes, like ssh-agent does for ssh.  It speaks the framed
+// envelope protocol over a unix socket that only its owner can connect to.
+
+// AgentDecrypt asks the agent to decrypt rsa pkcs1 v1.5 ciphertext.
+type AgentDecrypt struct {
+	Data []byte
+}
+
+func (a AgentDecrypt) Kind() string {
+	return "agent-decrypt"
+}
+
+func init() { registerRequestType(func() request { return new(AgentDecrypt) }) }
+
+// AgentSign asks the agent to sign a sha-256 digest with rsa pkcs1 v1.5.
+type AgentSign struct {
+	Digest []byte
+}
+
+func (a AgentSign) Kind() string {
+	return "agent-sign"
+}
+
+func init() { registerRequestType(func() request { return new(AgentSign) }) }
+
+// AgentPublicKey asks the agent for the public half of its key.  The
+// response is a KeyResponse.
+type AgentPublicKey struct{}
+
+func (a AgentPublicKey) Kind() string {
+	return "agent-public-key"
+}
+
+func init() { registerRequestType(func() request { return new(AgentPublicKey) }) }
+
+// AgentResult is the agent's response to a decrypt or sign request.
+type AgentResult struct {
+	Data []byte
+}
+
+func (a AgentResult) Kind() string {
+	return "agent-result"
+}
+
+func init() { registerRequestType(func() request { return new(AgentResult) }) }
+
+// defaultAgentSocket is where the agent listens if -agent isn't given: in a
+// directory of its own under the temp dir.  Anyone can create that directory
+// first, so if it isn't one that only we can use, $XDG_RUNTIME_DIR is used
+// instead.
+func defaultAgentSocket() (string, error) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("whisper-%d", os.Getuid()))
+	err := privateDir(dir)
+	if err == nil {
+		return filepath.Join(dir, "agent.sock"), nil
+	}
+	xdg := os.Getenv("XDG_RUNTIME_DIR")
+	if xdg == "" {
+		return "", fmt.Errorf("%v, and $XDG_RUNTIME_DIR is not set", err)
+	}
+	dir = filepath.Join(xdg, "whisper")
+	if err := privateDir(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "agent.sock"), nil
+}
+
+// privateDir creates dir if it doesn't exist, and checks that it's a real
+// directory, owned by us, that nobody else can get into.
+func privateDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("unable to create %s: %v", dir, err)
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not owned by us", dir)
+	}
+	if fi.Mode().Perm() != 0700 {
+		return fmt.Errorf("%s has mode %#o, expected 0700", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+func runAgent() {
+	key, err := privateKey()
+	if err != nil {
+		exit(1, "couldn't setup key: %v", err)
+	}
+	path := options.agent
+	if path == "" {
+		if path, err = defaultAgentSocket(); err != nil {
+			exit(1, "unable to find a safe place for the agent socket: %v", err)
+		}
+	}
+	l, err := listenUnix(path, 0600)
+	if err != nil {
+		exit(1, "couldn't start agent: %v", err)
+	}
+	fmt.Printf("WHISPER_AGENT=%s; export WHISPER_AGENT;\n", path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			error_log.Printf("error accepting agent connection: %v", err)
+			continue
+		}
+		go serveAgent(conn, key)
+	}
+}
+
+func serveAgent(conn net.Conn, key *rsa.PrivateKey) {
+	defer conn.Close()
+	c, err := acceptCodec(conn)
+	if err != nil {
+		error_log.Printf("agent connection error: %v", err)
+		return
+	}
+	for {
+		env, err := c.readEnvelope()
+		if err != nil {
+			if _, ok := err.(frameError); ok {
+				continue
+			}
+			if err != io.EOF {
+				error_log.Printf("agent connection error: %v", err)
+			}
+			return
+		}
+		res, err := agentRespond(env, key)
+		if err != nil {
+			res = errorDoc(err)
+		}
+		if err := writeRequest(c, env.Id, res); err != nil {
+			error_log.Printf("unable to send agent response: %v", err)
+			return
+		}
+	}
+}
+
+func agentRespond(env *Envelope, key *rsa.PrivateKey) (request, error) {
+	r, err := env.Open()
+	if err != nil {
+		return nil, err
+	}
+	switch v := r.(type) {
+	case *AgentDecrypt:
+		data, err := rsa.DecryptPKCS1v15(rand.Reader, key, v.Data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt: %v", err)
+		}
+		return AgentResult{Data: data}, nil
+	case *AgentSign:
+		if len(v.Digest) != sha256.Size {
+			return nil, fmt.Errorf("digest must be a %d byte sha-256 sum, not %d bytes", sha256.Size, len(v.Digest))
+		}
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, v.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("unable to sign: %v", err)
+		}
+		return AgentResult{Data: sig}, nil
+	case *AgentPublicKey:
+		return KeyResponse{Key: key.PublicKey}, nil
+	default:
+		return nil, errorf(codeUnsupported, "the agent does not handle %s requests", env.Kind)
+	}
+}
+
+// agentKey is a private key held by an agent.  It implements crypto.Signer
+// and crypto.Decrypter, so it can stand in for an *rsa.PrivateKey.
+type agentKey struct {
+	sync.Mutex
+	conn  net.Conn
+	codec codec
+	id    int
+	pub   *rsa.PublicKey
+}
+
+func dialAgent(path string) (*agentKey, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to agent: %v", err)
+	}
+	c, err := dialFrameCodec(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to agent: %v", err)
+	}
+	a := &agentKey{conn: conn, codec: c}
+	res, err := a.call(AgentPublicKey{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	k, ok := res.(*KeyResponse)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("agent sent unexpected response to public key request: %s", res.Kind())
+	}
+	a.pub = &k.Key
+	return a, nil
+}
+
+// call sends the agent a request and waits for its response.
+func (a *agentKey) call(r request) (request, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.id++
+	if err := writeRequest(a.codec, a.id, r); err != nil {
+		return nil, err
+	}
+	env, err := a.codec.readEnvelope()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read agent response: %v", err)
+	}
+	res, err := env.Open()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := res.(*ErrorDoc); ok {
+		return nil, e
+	}
+	return res, nil
+}
+
+func (a *agentKey) result(r request) ([]byte, error) {
+	res, err := a.call(r)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := res.(*AgentResult)
+	if !ok {
+		return nil, fmt.Errorf("agent sent unexpected response to %s request: %s", r.Kind(), res.Kind())
+	}
+	return v.Data, nil
+}
+
+func (a *agentKey) Public() crypto.PublicKey {
+	return a.pub
+}
+
+func (a *agentKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("the agent only signs sha-256 digests")
+	}
+	return a.result(AgentSign{Digest: digest})
+}
+
+// Decrypt decrypts rsa pkcs1 v1.5 ciphertext.  opts is ignored; no other
+// padding is supported.
+func (a *agentKey) Decrypt(_ io.Reader, msg []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	return a.result(AgentDecrypt{Data: msg})
+}
+
+func (a *agentKey) Close() error {
+	return a.conn.Close()
+}
+
+// privateKeyOps is the private key used by the command line tools: the
+// agent's, if there's one running, or else the one in the key file.
+type privateKeyOps interface {
+	crypto.Signer
+	crypto.Decrypter
+}
+
+func keyOps() (privateKeyOps, error) {
+	if options.agent != "" {
+		return dialAgent(options.agent)
+	}
+	return privateKey()
+}
+
+func sign() {
+	key, err := keyOps()
+	if err != nil {
+		exit(1, "couldn't setup key: %v", err)
+	}
+	msg, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		exit(1, "error reading input message: %v", err)
+	}
+	digest := sha256.Sum256(msg)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		exit(1, "error signing message: %v", err)
+	}
+	fmt.Print(base64.StdEncoding.EncodeToString(sig))
+}
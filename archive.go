@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// An archive is a portable copy of everything a server stores for one user.
+// Notes and messages were encrypted by the client before the server ever saw
+// them, and stay that way in the archive.  The rest of the user's database,
+// like the contact list and inbox policy, is carried as metadata.
+//
+// Archives can be taken from a running server with the admin/export client
+// command, or from a stopped one with `whisper export`.  Either way the
+// archive is read through a single iterator, so it's a consistent snapshot of
+// the database even while messages are arriving.
+
+// archiveVersion is the version of the archive format written by this server.
+// Archives with a higher version are refused.  Version 2 added Schema; the
+// notes and messages in version 1 archives are at schema 0.
+const archiveVersion = 2
+
+// Archive is a user's exported data.
+type Archive struct {
+	Version   int
+	Nick      string
+	Created   time.Time
+	Schema    int
+	PublicKey json.RawMessage
+	Notes     []ArchiveItem
+	Messages  []ArchiveItem
+	Meta      []ArchiveEntry
+}
+
+func (a Archive) Kind() string {
+	return "archive"
+}
+
+func init() { registerRequestType(func() request { return new(Archive) }) }
+
+// ArchiveItem is a note or message, exactly as it was stored.
+type ArchiveItem struct {
+	Id   int
+	Item json.RawMessage
+}
+
+// ArchiveEntry is any other key in the user's database.
+type ArchiveEntry struct {
+	Key   string
+	Value []byte
+}
+
+// ExportUser asks the server for an archive of a user's data.  It's
+// restricted to admins.
+type ExportUser struct {
+	Nick string
+}
+
+func (e ExportUser) Kind() string {
+	return "export-user"
+}
+
+func init() { registerRequestType(func() request { return new(ExportUser) }) }
+
+// ImportUser asks the server to load an archive.  OnConflict says what to do
+// if the user already exists; see importArchive.  It's restricted to admins.
+type ImportUser struct {
+	Archive    Archive
+	OnConflict string
+}
+
+func (i ImportUser) Kind() string {
+	return "import-user"
+}
+
+func init() { registerRequestType(func() request { return new(ImportUser) }) }
+
+// keys that are rebuilt on import rather than carried in an archive.
+var unarchivedPrefixes = []string{seqPrefix, schemaKey}
+
+func (db *userdb) exportArchive(nick string) (*Archive, error) {
+	schema, err := db.schema()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read schema version: %v", err)
+	}
+	it := db.NewIterator(nil)
+	defer it.Release()
+
+	a := &Archive{Version: archiveVersion, Nick: nick, Created: time.Now().UTC(), Schema: schema}
+	for it.Next() {
+		key, val := string(it.Key()), copyBytes(it.Value())
+		switch {
+		case key == "public_key":
+			a.PublicKey = val
+		case strings.HasPrefix(key, "notes/"), strings.HasPrefix(key, "messages/"):
+			prefix, id_s := splitKey([]byte(key))
+			id, err := decodeInt(string(id_s))
+			if err != nil {
+				return nil, fmt.Errorf("bad key %s: %v", key, err)
+			}
+			item := ArchiveItem{Id: id, Item: val}
+			if string(prefix) == "notes/" {
+				a.Notes = append(a.Notes, item)
+			} else {
+				a.Messages = append(a.Messages, item)
+			}
+		case hasAnyPrefix(key, unarchivedPrefixes):
+		default:
+			a.Meta = append(a.Meta, ArchiveEntry{Key: key, Value: val})
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, fmt.Errorf("unable to read database: %v", err)
+	}
+	if a.PublicKey == nil {
+		return nil, fmt.Errorf("%s has no public key", nick)
+	}
+	return a, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// importArchive loads an archive into the database of the user it belongs to.
+// If that user already exists, onConflict decides what happens:
+//
+//	fail     refuse the import (the default)
+//	merge    add the archive's notes and messages after the existing ones,
+//	         and any metadata the user doesn't already have.  The public
+//	         keys must match.
+//	replace  throw away the user's existing data first.
+//
+// Notes and messages are migrated up to the current schema first.  The whole
+// import is written in one batch, so it either happens or doesn't.
+func importArchive(a *Archive, onConflict string) (string, error) {
+	if a.Version < 1 || a.Version > archiveVersion {
+		return "", fmt.Errorf("archive version %d is not supported; this server reads versions 1 to %d", a.Version, archiveVersion)
+	}
+	if a.Version == 1 {
+		a.Schema = 0
+	}
+	if err := migrateItems("notes/", a.Notes, a.Schema); err != nil {
+		return "", err
+	}
+	if err := migrateItems("messages/", a.Messages, a.Schema); err != nil {
+		return "", err
+	}
+	switch onConflict {
+	case "":
+		onConflict = "fail"
+	case "fail", "merge", "replace":
+	default:
+		return "", fmt.Errorf("unknown conflict mode %q: must be fail, merge or replace", onConflict)
+	}
+	nick, err := canonicalNick(a.Nick)
+	if err != nil {
+		return "", err
+	}
+	if len(a.PublicKey) == 0 {
+		return "", fmt.Errorf("archive has no public key")
+	}
+	for _, e := range a.Meta {
+		if e.Key == "public_key" || hasAnyPrefix(e.Key, unarchivedPrefixes) || hasAnyPrefix(e.Key, orderedPrefixes) {
+			return "", fmt.Errorf("archive metadata may not contain %s", e.Key)
+		}
+	}
+
+	db, err := getUserDB(nick, true)
+	if err != nil {
+		return "", err
+	}
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+
+	existing, err := db.Get([]byte("public_key"))
+	switch err {
+	case nil:
+	case errNotFound:
+		existing = nil
+	default:
+		return "", err
+	}
+	if existing == nil {
+		onConflict = "replace"
+	}
+
+	var b batch
+	switch onConflict {
+	case "fail":
+		return "", errorf(codeRejected, "%s already exists on this server", nick)
+	case "replace":
+		it := db.NewIterator(nil)
+		for it.Next() {
+			b.Delete(copyBytes(it.Key()))
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return "", err
+		}
+		b.Put([]byte("public_key"), a.PublicKey)
+		for _, e := range a.Meta {
+			b.Put([]byte(e.Key), e.Value)
+		}
+		for prefix, items := range map[string][]ArchiveItem{"notes/": a.Notes, "messages/": a.Messages} {
+			next := 0
+			for _, item := range items {
+				b.Put([]byte(prefix+encodeInt(item.Id)), item.Item)
+				if item.Id >= next {
+					next = item.Id + 1
+				}
+			}
+			b.Put([]byte(seqPrefix+prefix), []byte(encodeInt(next)))
+		}
+	case "merge":
+		var have, got rsa.PublicKey
+		if err := json.Unmarshal(existing, &have); err != nil {
+			return "", fmt.Errorf("unable to read %s's public key: %v", nick, err)
+		}
+		if err := json.Unmarshal(a.PublicKey, &got); err != nil {
+			return "", fmt.Errorf("unable to read archive's public key: %v", err)
+		}
+		if have.E != got.E || have.N == nil || got.N == nil || have.N.Cmp(got.N) != 0 {
+			return "", errorf(codeRejected, "archive's public key doesn't match the one %s has on this server", nick)
+		}
+		for _, e := range a.Meta {
+			if _, err := db.Get([]byte(e.Key)); err == errNotFound {
+				b.Put([]byte(e.Key), e.Value)
+			}
+		}
+		for prefix, items := range map[string][]ArchiveItem{"notes/": a.Notes, "messages/": a.Messages} {
+			next, err := db.nextID(prefix)
+			if err != nil {
+				return "", err
+			}
+			for _, item := range items {
+				b.Put([]byte(prefix+encodeInt(next)), item.Item)
+				next++
+			}
+			b.Put([]byte(seqPrefix+prefix), []byte(encodeInt(next)))
+		}
+	}
+	b.Put([]byte(schemaKey), []byte(encodeInt(schemaVersion())))
+	if err := db.Write(&b); err != nil {
+		return "", fmt.Errorf("unable to write archive: %v", err)
+	}
+
+	// the import bypasses the quota counters, so have them recounted.
+	db.usageLock.Lock()
+	db.usage = nil
+	db.usageLock.Unlock()
+	return nick, nil
+}
+
+func (s *serverConnection) handleExportUser(body json.RawMessage) (request, error) {
+	if !isAdmin(s.nick) {
+		return nil, errorf(codeForbidden, "exports are restricted to admins")
+	}
+	var req ExportUser
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad export request: %v", err)
+	}
+	nick, err := canonicalNick(req.Nick)
+	if err != nil {
+		return nil, err
+	}
+	db, err := getUserDB(nick, false)
+	if err != nil {
+		return nil, err
+	}
+	a, err := db.exportArchive(nick)
+	if err != nil {
+		return nil, err
+	}
+	info_log.Printf("%s exported %s: %d notes, %d messages", s.nick, nick, len(a.Notes), len(a.Messages))
+	return a, nil
+}
+
+func (s *serverConnection) handleImportUser(body json.RawMessage) (request, error) {
+	if !isAdmin(s.nick) {
+		return nil, errorf(codeForbidden, "imports are restricted to admins")
+	}
+	var req ImportUser
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad import request: %v", err)
+	}
+	nick, err := importArchive(&req.Archive, req.OnConflict)
+	if err != nil {
+		return nil, err
+	}
+	info_log.Printf("%s imported %s: %d notes, %d messages", s.nick, nick, len(req.Archive.Notes), len(req.Archive.Messages))
+	return Bool(true), nil
+}
+
+// exportUser writes an archive of -nick to stdout.  The server must not be
+// running, since it holds the databases open; use admin/export for a running
+// server.
+func exportUser() {
+	// the archive goes to stdout, so keep the logs out of it.
+	info_log = log.New(os.Stderr, "", 0)
+	if err := setupStorage(); err != nil {
+		exit(1, "%v", err)
+	}
+	nick, err := canonicalNick(options.nick)
+	if err != nil {
+		exit(1, "export needs a valid -nick: %v", err)
+	}
+	db, err := getUserDB(nick, false)
+	if err != nil {
+		exit(1, "unable to open database (is the server running? use admin/export from a client instead): %v", err)
+	}
+	defer closeDBs()
+
+	a, err := db.exportArchive(nick)
+	if err != nil {
+		exit(1, "unable to export %s: %v", nick, err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a); err != nil {
+		exit(1, "unable to write archive: %v", err)
+	}
+}
+
+// importUser loads an archive from stdin.  Like exportUser, it's for a server
+// that isn't running.
+func importUser() {
+	if err := setupStorage(); err != nil {
+		exit(1, "%v", err)
+	}
+	raw, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		exit(1, "unable to read archive: %v", err)
+	}
+	var a Archive
+	if err := json.Unmarshal(raw, &a); err != nil {
+		exit(1, "unable to parse archive: %v", err)
+	}
+	defer closeDBs()
+
+	nick, err := importArchive(&a, options.onConflict)
+	if err != nil {
+		exit(1, "unable to import archive: %v", err)
+	}
+	info_log.Printf("imported %s: %d notes, %d messages", nick, len(a.Notes), len(a.Messages))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	memoryUsers(t, "archive-test", "archive-copy")
+
+	db, err := getUserDB("archive-test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("public_key"), []byte(`{"N":1,"E":3}`))
+	db.Put([]byte(contactsPrefix+"bob"), nil)
+	for _, prefix := range []string{"notes/", "messages/"} {
+		for i := 0; i < 3; i++ {
+			if _, err := db.appendItem(prefix, []byte(`{"n":1}`)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	a, err := db.exportArchive("archive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Notes) != 3 || len(a.Messages) != 3 || len(a.Meta) != 1 {
+		t.Fatalf("expected 3 notes, 3 messages and 1 metadata entry, saw %d, %d and %d", len(a.Notes), len(a.Messages), len(a.Meta))
+	}
+
+	if _, err := importArchive(a, "fail"); err == nil {
+		t.Errorf("import over an existing user should fail by default")
+	}
+	if _, err := importArchive(a, "merge"); err != nil {
+		t.Fatalf("unable to merge: %v", err)
+	}
+	if ids := countKeys(db, "notes/"); ids != 6 {
+		t.Errorf("expected 6 notes after merging, saw %d", ids)
+	}
+	if key, _ := db.appendItem("notes/", []byte(`{}`)); key != "notes/"+encodeInt(6) {
+		t.Errorf("expected the next note to be 6 after merging, saw %s", key)
+	}
+
+	if _, err := importArchive(a, "replace"); err != nil {
+		t.Fatalf("unable to replace: %v", err)
+	}
+	if ids := countKeys(db, "notes/"); ids != 3 {
+		t.Errorf("expected 3 notes after replacing, saw %d", ids)
+	}
+	if ok, _ := db.isContact("bob"); !ok {
+		t.Errorf("contacts weren't imported")
+	}
+
+	a.Nick = "archive-copy"
+	if _, err := importArchive(a, "fail"); err != nil {
+		t.Fatalf("unable to import a new user: %v", err)
+	}
+	copy, err := getUserDB("archive-copy", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := countKeys(copy, "messages/"); ids != 3 {
+		t.Errorf("expected 3 messages in the copy, saw %d", ids)
+	}
+
+	a.Version = archiveVersion + 1
+	if _, err := importArchive(a, "replace"); err == nil {
+		t.Errorf("imported an archive from the future")
+	}
+}
+
+func countKeys(db *userdb, prefix string) int {
+	it := db.NewIterator([]byte(prefix))
+	defer it.Release()
+	n := 0
+	for it.Next() {
+		n++
+	}
+	return n
+}
@@ -14,3 +14,37 @@ func (a *AuthRequest) Kind() string {
 }
 
 func init() { registerRequestType(func() request { return new(AuthRequest) }) }
+
+// AuthChallenge is the server's response to an AuthRequest: a random nonce,
+// encrypted with the public key presented in the request.
+type AuthChallenge struct {
+	Nonce []byte
+}
+
+func (a AuthChallenge) Kind() string {
+	return "auth-challenge"
+}
+
+func init() { registerRequestType(func() request { return new(AuthChallenge) }) }
+
+// AuthProof completes authentication by returning the decrypted nonce from
+// an AuthChallenge.
+type AuthProof struct {
+	Nonce []byte
+}
+
+func (a AuthProof) Kind() string {
+	return "auth-proof"
+}
+
+func init() { registerRequestType(func() request { return new(AuthProof) }) }
+
+// authChallenge is the server's record of an outstanding AuthChallenge.  A
+// nick's first key is only saved once the client has proved it holds it.
+type authChallenge struct {
+	nick   string
+	key    *rsa.PublicKey
+	db     *userdb
+	nonce  []byte
+	newKey bool
+}
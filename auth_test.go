@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	memoryUsers(t, "auth-test")
+
+	connect := func() *serverConnection {
+		server, client := net.Pipe()
+		t.Cleanup(func() { client.Close(); server.Close() })
+		s := &serverConnection{conn: server, limit: newBucket(&options.connLimit)}
+		if _, err := s.handleRequest(envelope(t, newHello())); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := func(s *serverConnection, nick string, pub *rsa.PublicKey, priv *rsa.PrivateKey) error {
+		res, err := s.handleRequest(envelope(t, &AuthRequest{Nick: nick, Key: pub}))
+		if err != nil {
+			return err
+		}
+		nonce := []byte("a guess")
+		if priv != nil {
+			if nonce, err = rsa.DecryptPKCS1v15(rand.Reader, priv, res.(AuthChallenge).Nonce); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = s.handleRequest(envelope(t, &AuthProof{Nonce: nonce}))
+		return err
+	}
+	storedKey := func() *rsa.PublicKey {
+		db, err := getUserDB("auth-test", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := db.getPublicKey()
+		if err != nil {
+			return nil
+		}
+		return key
+	}
+
+	s := connect()
+	_, err = s.handleRequest(envelope(t, &ListNotes{N: 5}))
+	if doc, ok := err.(ErrorDoc); !ok || doc.Code != codeUnauthenticated {
+		t.Errorf("listing notes before authenticating should be refused, saw %v", err)
+	}
+	_, err = s.handleRequest(envelope(t, &Message{To: "auth-test"}))
+	if doc, ok := err.(ErrorDoc); !ok || doc.Code != codeUnauthenticated {
+		t.Errorf("sending a message before authenticating should be refused, saw %v", err)
+	}
+
+	// a new nick's key isn't kept until the client proves it holds it.
+	if err := auth(s, "auth-test", &key.PublicKey, nil); err == nil {
+		t.Fatalf("authenticated without answering the challenge")
+	}
+	if storedKey() != nil {
+		t.Errorf("a failed proof saved the key")
+	}
+	if err := auth(s, "auth-test", &key.PublicKey, key); err != nil {
+		t.Fatalf("a new user couldn't authenticate: %v", err)
+	}
+	if _, err := s.handleRequest(envelope(t, &ListNotes{N: 5})); err != nil {
+		t.Errorf("unable to list notes after authenticating: %v", err)
+	}
+	if k := storedKey(); k == nil || k.N.Cmp(key.N) != 0 {
+		t.Errorf("the key wasn't saved after a successful proof")
+	}
+	removeSession(s)
+
+	// anyone can get a user's public key, but that isn't enough to log in.
+	s = connect()
+	if err := auth(s, "auth-test", &key.PublicKey, nil); err == nil {
+		t.Errorf("authenticated with only the public key")
+	}
+	if s.nick != "" {
+		t.Errorf("a failed proof left the connection authenticated as %s", s.nick)
+	}
+
+	s = connect()
+	if err := auth(s, "auth-test", &other.PublicKey, other); err == nil {
+		t.Errorf("authenticated with the wrong key")
+	}
+	if k := storedKey(); k == nil || k.N.Cmp(key.N) != 0 {
+		t.Errorf("a failed auth replaced the stored key")
+	}
+}
+
+func envelope(t *testing.T, r request) Envelope {
+	body, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Envelope{Kind: r.Kind(), Body: body}
+}
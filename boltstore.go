@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// boltBucket is the bucket holding every key in a boltStore.
+var boltBucket = []byte("whisper")
+
+// boltStore is a store kept in a single bolt database file.
+type boltStore struct {
+	db *bbolt.DB
+}
+
+func openBolt(name string, create bool) (store, error) {
+	path := filepath.Join(options.dataDir, name+".bolt")
+	if !create {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("unable to open db file at %s: %v", path, err)
+		}
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open db file at %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to open db file at %s: %v", path, err)
+	}
+	info_log.Printf("opened database file: %s", path)
+	return &boltStore{db: db}, nil
+}
+
+// Get uses a cursor rather than Bucket.Get, since Bucket.Get can't tell a
+// missing key from one with an empty value.
+func (b *boltStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		k, v := tx.Bucket(boltBucket).Cursor().Seek(key)
+		if k == nil || !bytes.Equal(k, key) {
+			return errNotFound
+		}
+		val = copyBytes(v)
+		return nil
+	})
+	return val, err
+}
+
+func (b *boltStore) Put(key, value []byte) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (b *boltStore) Delete(key []byte) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(key)
+	})
+}
+
+func (b *boltStore) Write(wb *batch) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, op := range wb.ops {
+			var err error
+			if op.delete {
+				err = bucket.Delete(op.key)
+			} else {
+				err = bucket.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
+
+// NewIterator copies the matching keys out of a read transaction rather than
+// holding the transaction open, since bolt can deadlock if a goroutine writes
+// while it has a read transaction open.
+func (b *boltStore) NewIterator(prefix []byte) iterator {
+	it := &memIterator{pos: -1}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			it.keys = append(it.keys, string(k))
+			it.values = append(it.values, copyBytes(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return &memIterator{pos: -1, err: err}
+	}
+	return it
+}
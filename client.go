@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -11,62 +12,140 @@ import (
 	"fmt"
 	"golang.org/x/crypto/ssh/terminal"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
 type Client struct {
-	key          *rsa.PrivateKey
-	host         string
-	port         int
-	nick         string
-	conn         net.Conn
-	done         chan interface{}
-	mu           sync.Mutex
-	prompt       string
-	line         []rune
-	prev         *terminal.State
-	keyStore     map[string]rsa.PublicKey
+	key      *rsa.PrivateKey
+	host     string
+	port     int
+	nick     string
+	conn     transport
+	codec    codec
+	server   *peerInfo
+	done     chan interface{}
+	mu       sync.Mutex
+	prompt   string
+	line     []rune
+	prev     *terminal.State
+	keyStore map[string]rsa.PublicKey
+	book     *addressBook
+	plock    sync.Mutex
+	presence map[string]string
+	status   string // our own published presence
+	unread   int    // shown in the prompt; guarded by mu
+
+	rlock        sync.Mutex // guards state, requestCount, outstanding and writes
+	state        connState
 	requestCount int
-	outstanding  map[int]chan request
+	outstanding  map[int]*pending
+}
+
+// addr is the address of the server, for display: host:port, or the url for
+// websocket servers.
+func (c *Client) addr() string {
+	if isWebSocketURL(c.host) {
+		return c.host
+	}
+	if _, ok := unixSocketPath(c.host); ok {
+		return c.host
+	}
+	return fmt.Sprintf("%s:%d", c.host, c.port)
 }
 
 // establishes a connection to the server
 func (c *Client) dial() error {
-	addr := fmt.Sprintf("%s:%d", c.host, c.port)
+	addr := c.addr()
 	c.info("dialing %s", addr)
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("client unable to connect: %v", err)
+	var (
+		conn transport
+		cc   codec
+		err  error
+	)
+	if isWebSocketURL(c.host) {
+		conn, cc, err = dialWebSocket(c.host)
+		if err != nil {
+			return fmt.Errorf("client unable to connect: %v", err)
+		}
+	} else {
+		network := "tcp"
+		if path, ok := unixSocketPath(c.host); ok {
+			network, addr = "unix", path
+		}
+		nc, err := net.Dial(network, addr)
+		if err != nil {
+			return fmt.Errorf("client unable to connect: %v", err)
+		}
+		cc, err = dialCodec(nc)
+		if err != nil {
+			nc.Close()
+			return fmt.Errorf("client unable to connect: %v", err)
+		}
+		conn = nc
 	}
-	c.info("connected to %s", addr)
+	c.info("connected to %s", c.addr())
+
+	c.rlock.Lock()
 	c.conn = conn
-	c.prompt = fmt.Sprintf("%s> ", addr)
-	go c.handleMessages()
+	c.codec = cc
+	c.server = nil
+	c.rlock.Unlock()
+
+	go c.handleMessages(conn, cc)
 	return nil
 }
 
 // handles messages received from the current server
-func (c *Client) handleMessages() {
+func (c *Client) handleMessages(conn transport, cc codec) {
 	messages := make(chan Envelope)
 	errors := make(chan error)
 	done := make(chan interface{})
-	go stream(c.conn, messages, errors, done)
+	// this loop reads the stream until it ends, so it never needs telling to
+	// quit.
+	go stream(cc, messages, errors, done, nil)
+	ticker := heartbeatTicker()
+	defer ticker.Stop()
+	last := time.Now()
 	for {
 		select {
+		case <-ticker.C:
+			ping, dead := heartbeat(time.Since(last))
+			if dead {
+				// closing the connection ends the stream, which sends us
+				// down the reconnect path.
+				c.err("nothing heard from server for %v; dropping connection", time.Since(last))
+				conn.Close()
+				continue
+			}
+			if ping {
+				// this fails harmlessly while we're still handshaking or
+				// if the server predates heartbeats.
+				if _, err := c.sendRequest(Ping{}); err != nil {
+					c.info("unable to send ping: %v", err)
+				}
+			}
 		case message := <-messages:
+			last = time.Now()
 			if err := c.handleMessage(message); err != nil {
 				c.err("error handling message from server: %v", err)
 			}
 		case err := <-errors:
+			last = time.Now()
 			c.err("server error: %v", err)
 		case <-done:
+			conn.Close()
+			c.disconnected(conn)
 			return
 		}
 	}
@@ -74,8 +153,14 @@ func (c *Client) handleMessages() {
 
 // handle a message received from the server
 func (c *Client) handleMessage(m Envelope) error {
+	if m.Id == pushId {
+		return c.handlePush(m)
+	}
 	c.info("received response for message %d", m.Id)
+	c.rlock.Lock()
 	p, ok := c.outstanding[m.Id]
+	delete(c.outstanding, m.Id)
+	c.rlock.Unlock()
 	if !ok {
 		c.info("%v", m)
 		c.err("received message corresponding to no known request id: %d", m.Id)
@@ -83,30 +168,60 @@ func (c *Client) handleMessage(m Envelope) error {
 	}
 	r, err := m.Open()
 	if err != nil {
-		p <- ErrorDoc(err.Error())
+		p.complete(&ErrorDoc{Message: err.Error()})
 	} else {
-		p <- r
+		p.complete(r)
 	}
-	close(p)
 	return nil
 }
 
-func (c *Client) handleNote(enote *EncryptedNote) error {
-	c.info("aes key ciphertext: %x", enote.Key)
+// handle a message that the server sent on its own initiative
+func (c *Client) handlePush(m Envelope) error {
+	r, err := m.Open()
+	if err != nil {
+		return err
+	}
+	switch v := r.(type) {
+	case *Ping:
+		c.rlock.Lock()
+		defer c.rlock.Unlock()
+		return writeRequest(c.codec, pushId, Pong{})
+	case *ServerShutdown:
+		// the connection is about to drop, and the usual reconnect takes
+		// over from there.
+		c.err("%s", v.Reason)
+	case *Presence:
+		c.setPresence(v.Nick, v.Status)
+		c.info("%s is %s", v.Nick, v.Status)
+	default:
+		return fmt.Errorf("received push of unexpected type: %v", reflect.TypeOf(v))
+	}
+	return nil
+}
+
+func (c *Client) decryptNote(enote *EncryptedNote) (title, body []byte, err error) {
 	key, err := rsa.DecryptPKCS1v15(rand.Reader, c.key, enote.Key)
 	if err != nil {
-		return fmt.Errorf("unable to decrypt aes key from note: %v", err)
+		return nil, nil, fmt.Errorf("unable to decrypt aes key from note: %v", err)
 	}
-	c.info("aes key: %x", key)
 
-	title, err := c.aesDecrypt(key, enote.Title)
+	title, err = c.aesDecrypt(key, enote.Title)
 	if err != nil {
-		return fmt.Errorf("unable to decrypt note title: %v", err)
+		return nil, nil, fmt.Errorf("unable to decrypt note title: %v", err)
 	}
 
-	body, err := c.aesDecrypt(key, enote.Body)
+	body, err = c.aesDecrypt(key, enote.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decrypt note body: %v", err)
+	}
+	return title, body, nil
+}
+
+func (c *Client) handleNote(enote *EncryptedNote) error {
+	c.info("aes key ciphertext: %x", enote.Key)
+	title, body, err := c.decryptNote(enote)
 	if err != nil {
-		return fmt.Errorf("unable to decrypt note body: %v", err)
+		return err
 	}
 
 	fmt.Print("\033[37m")
@@ -117,11 +232,11 @@ func (c *Client) handleNote(enote *EncryptedNote) error {
 }
 
 func (c *Client) handleListNotes(notes ListNotesResponse) error {
-	writeNoteTitle := func(id int, title string) {
+	writeNoteTitle := func(id int, title string, received time.Time) {
 		c.mu.Lock()
 		defer c.mu.Unlock()
 		c.trunc()
-		fmt.Printf("%d\t%s\n", id, title)
+		fmt.Printf("%d\t%s\t%s\n", id, title, ago(received, time.Now()))
 		c.renderLine()
 	}
 
@@ -138,50 +253,134 @@ func (c *Client) handleListNotes(notes ListNotesResponse) error {
 			continue
 		}
 
-		writeNoteTitle(note.Id, string(title))
+		writeNoteTitle(note.Id, strings.TrimRight(string(title), " "), note.Received)
 	}
 	return nil
 }
 
+// negotiate exchanges hellos with the server to agree on a protocol version.
+func (c *Client) negotiate() error {
+	promise, err := c.send(context.Background(), newHello(), true)
+	if err != nil {
+		return err
+	}
+	switch v := (<-promise).(type) {
+	case *Hello:
+		peer, err := negotiate(v)
+		if err != nil {
+			return fmt.Errorf("unable to talk to server: %v", err)
+		}
+		c.server = peer
+		c.info("negotiated %v", peer)
+		return nil
+	case *ErrorDoc:
+		if v.Code == "" && strings.HasPrefix(v.Message, "no such request type") {
+			return fmt.Errorf("server predates protocol negotiation and speaks protocol version 1; this client requires version %d or newer", minProtocolVersion)
+		}
+		return fmt.Errorf("unable to negotiate protocol: %v", v.Error())
+	default:
+		return fmt.Errorf("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+// handshake negotiates a protocol version and authenticates.  It's run on
+// every new connection to the server.
 func (c *Client) handshake() error {
+	if err := c.negotiate(); err != nil {
+		return err
+	}
 	r := &AuthRequest{Nick: c.nick, Key: &c.key.PublicKey}
 	c.info("authenticating as %s", c.nick)
-	promise, err := c.sendRequest(r)
+	promise, err := c.send(context.Background(), r, true)
 	if err != nil {
 		return err
 	}
 	res := <-promise
 	switch v := res.(type) {
 	case *ErrorDoc:
-		close(c.done)
+		return v
+	case *AuthChallenge:
+		nonce, err := c.rsaDecrypt(v.Nonce)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt auth challenge: %v", err)
+		}
+		promise, err = c.send(context.Background(), AuthProof{Nonce: nonce}, true)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+
+	res = <-promise
+	switch v := res.(type) {
+	case *ErrorDoc:
 		return v
 	case *Bool:
-		c.renderLine()
 		return nil
 	default:
-		close(c.done)
 		return fmt.Errorf("received response of unexpected type: %v", reflect.TypeOf(v))
 	}
 }
 
+// sends a request to the server, returning a channel on which its response
+// will be delivered.  If no response arrives within the request timeout, an
+// error is delivered instead.
 func (c *Client) sendRequest(r request) (chan request, error) {
-	e, err := wrapRequest(c.requestCount, r)
-	if err != nil {
+	return c.sendRequestContext(context.Background(), r)
+}
+
+// sendRequestContext is like sendRequest, but the request is also failed if
+// ctx ends before its response arrives.
+func (c *Client) sendRequestContext(ctx context.Context, r request) (chan request, error) {
+	return c.send(ctx, r, false)
+}
+
+// send sends a request.  Until the handshake has completed on a connection,
+// only handshake requests may be sent.
+func (c *Client) send(ctx context.Context, r request, handshake bool) (chan request, error) {
+	cancel := context.CancelFunc(func() {})
+	if options.requestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, options.requestTimeout)
+	}
+	p := newPending(ctx, r)
+	if err := c.dispatch(p, handshake); err != nil {
+		cancel()
 		return nil, err
 	}
+	go c.expire(p, cancel)
+	return p.res, nil
+}
+
+// dispatch writes a pending request to the current connection under a new
+// request id.
+func (c *Client) dispatch(p *pending, handshake bool) error {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	if !handshake && c.state != stateConnected {
+		return errorf(codeDisconnected, "not connected to the server")
+	}
+	if err := c.server.checkSupported(p.req.Kind()); err != nil {
+		return err
+	}
+	e, err := wrapRequest(c.requestCount, p.req)
+	if err != nil {
+		return err
+	}
 	b, err := json.Marshal(e)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	res := make(chan request, 1)
-	c.outstanding[c.requestCount] = res
+	c.outstanding[e.Id] = p
 	c.requestCount++
 	c.info("sending json request: %s", b)
-	if _, err := c.conn.Write(b); err != nil {
-		return nil, err
+	if err := c.codec.writeEnvelope(e); err != nil {
+		delete(c.outstanding, e.Id)
+		return err
 	}
-	return res, nil
+	return nil
 }
 
 func (c *Client) info(template string, args ...interface{}) {
@@ -226,11 +425,17 @@ func (c *Client) run() {
 	if err := c.dial(); err != nil {
 		exit(1, "%v", err)
 	}
-	defer c.conn.Close()
 	if err := c.handshake(); err != nil {
 		exit(1, "%v", err)
 	}
+	c.setState(stateConnected)
+	if err := c.syncBook(); err != nil {
+		c.err("%v", err)
+	}
+	c.refreshUnread()
 	<-c.done
+	c.setState(stateClosed)
+	c.conn.Close()
 	if c.prev != nil {
 		terminal.Restore(0, c.prev)
 	}
@@ -248,6 +453,8 @@ func (c *Client) control(r rune) {
 		c.eof()
 	case 4: // EOF
 		c.eof()
+	case 9: // tab
+		c.complete()
 	case 12: // ctrl+l
 		c.clear()
 	case 13: // enter
@@ -282,14 +489,57 @@ func (c *Client) exec(line string) {
 		c.getNote(parts[1:])
 	case "notes/list":
 		c.listNotes(parts[1:])
+	case "notes/export":
+		c.exportNotes(parts[1:])
+	case "notes/import":
+		c.importNotes(parts[1:])
 	case "keys/get":
 		c.fetchKey(parts[1:])
 	case "msg/send":
 		c.sendMessage(parts[1:])
 	case "msg/list":
 		c.listMessages(parts[1:])
+		c.refreshUnread()
 	case "msg/get":
 		c.getMessage(parts[1:])
+		c.refreshUnread()
+	case "msg/read", "msg/unread", "msg/archive", "msg/unarchive", "msg/star", "msg/unstar":
+		c.setMessageFlag(strings.TrimPrefix(parts[0], "msg/"), parts[1:])
+		c.refreshUnread()
+	case "contacts/add":
+		c.updateContact("add", parts[1:])
+	case "contacts/remove":
+		c.updateContact("remove", parts[1:])
+	case "contacts/block":
+		c.updateContact("block", parts[1:])
+	case "contacts/unblock":
+		c.updateContact("unblock", parts[1:])
+	case "contacts/list":
+		c.listContacts(parts[1:])
+	case "contacts/only":
+		c.setInboxPolicy(parts[1:])
+	case "presence/set":
+		c.publishPresence(parts[1:])
+	case "presence/hide":
+		c.hidePresence(parts[1:])
+	case "book/add":
+		c.bookAdd(parts[1:])
+	case "book/remove":
+		c.bookRemove(parts[1:])
+	case "book/note":
+		c.bookNote(parts[1:])
+	case "book/pin":
+		c.bookPin(parts[1:])
+	case "book/list":
+		c.bookList(parts[1:])
+	case "book/sync":
+		c.bookSync(parts[1:])
+	case "admin/usage":
+		c.usageReport(parts[1:])
+	case "admin/export":
+		c.exportUser(parts[1:])
+	case "admin/import":
+		c.importUser(parts[1:])
 	default:
 		c.err("unrecognized client command: %s", parts[0])
 	}
@@ -317,8 +567,18 @@ func (c *Client) createNote(args []string) {
 		c.err("%v", err)
 		return
 	}
-	if _, err := c.sendRequest(note); err != nil {
+	p, err := c.sendRequest(note)
+	if err != nil {
 		c.err("error sending note: %v", err)
+		return
+	}
+	switch v := (<-p).(type) {
+	case *Bool:
+		c.info("note saved")
+	case *ErrorDoc:
+		c.err("error saving note: %v", v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
 	}
 }
 
@@ -355,6 +615,7 @@ func (c *Client) listNotes(args []string) {
 	p, err := c.sendRequest(r)
 	if err != nil {
 		c.err("%v", err)
+		return
 	}
 	res := <-p
 	switch v := res.(type) {
@@ -381,7 +642,6 @@ func (c *Client) encryptNote(title string, message []byte) (*EncryptedNote, erro
 	if err != nil {
 		return nil, fmt.Errorf("couldn't encrypt note: failed to make aes key bytes: %v", err)
 	}
-	c.info("aes key: %x", key)
 
 	ctitle, err := c.aesEncrypt(key, []byte(note.Title))
 	if err != nil {
@@ -408,6 +668,195 @@ func (c *Client) encryptNote(title string, message []byte) (*EncryptedNote, erro
 	}, nil
 }
 
+// fetchNotes pages through every note, newest first, and decrypts them.
+func (c *Client) fetchNotes() ([]exportedNote, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	var notes []exportedNote
+	before := 0
+	for {
+		p, err := c.sendRequest(ListNotes{N: maxListNotes, Before: before})
+		if err != nil {
+			return nil, err
+		}
+		var page ListNotesResponse
+		switch v := (<-p).(type) {
+		case *ListNotesResponse:
+			page = *v
+		case *ErrorDoc:
+			return nil, fmt.Errorf("error listing notes: %v", v.Error())
+		default:
+			return nil, fmt.Errorf("received response of unexpected type: %v", reflect.TypeOf(v))
+		}
+		if len(page) == 0 {
+			return notes, nil
+		}
+		for _, item := range page {
+			p, err := c.sendRequest(GetNoteRequest{Id: item.Id})
+			if err != nil {
+				return nil, err
+			}
+			switch v := (<-p).(type) {
+			case *EncryptedNote:
+				title, body, err := c.decryptNote(v)
+				if err != nil {
+					return nil, fmt.Errorf("note %d: %v", item.Id, err)
+				}
+				notes = append(notes, exportedNote{
+					Id:       item.Id,
+					Title:    strings.TrimRight(string(title), " "),
+					Body:     strings.TrimRight(string(body), " "),
+					Received: item.Received,
+					Exported: now,
+				})
+			case *ErrorDoc:
+				return nil, fmt.Errorf("error getting note %d: %v", item.Id, v.Error())
+			default:
+				return nil, fmt.Errorf("received response of unexpected type: %v", reflect.TypeOf(v))
+			}
+			before = item.Id
+		}
+		if before == 0 {
+			return notes, nil
+		}
+	}
+}
+
+// exportNotes writes every note to a directory of markdown files, or with
+// --passphrase, to a single archive sealed with a passphrase.
+func (c *Client) exportNotes(args []string) {
+	sealed := len(args) == 2 && args[0] == "--passphrase"
+	if len(args) != 1 && !sealed {
+		c.err("notes/export takes a directory, or --passphrase and a file")
+		return
+	}
+	path := args[len(args)-1]
+
+	var passphrase []byte
+	if sealed {
+		var err error
+		if passphrase, err = c.readPassphrase("passphrase: "); err != nil {
+			c.err("%v", err)
+			return
+		}
+		again, err := c.readPassphrase("again: ")
+		if err != nil {
+			c.err("%v", err)
+			return
+		}
+		if !bytes.Equal(passphrase, again) {
+			c.err("passphrases don't match")
+			return
+		}
+	}
+
+	notes, err := c.fetchNotes()
+	if err != nil {
+		c.err("unable to export notes: %v", err)
+		return
+	}
+
+	if sealed {
+		b, err := sealNotes(notes, passphrase)
+		if err != nil {
+			c.err("unable to seal notes: %v", err)
+			return
+		}
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			c.err("unable to write archive: %v", err)
+			return
+		}
+		c.info("exported %d notes to %s", len(notes), path)
+		return
+	}
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		c.err("unable to create export directory: %v", err)
+		return
+	}
+	for _, n := range notes {
+		if err := ioutil.WriteFile(filepath.Join(path, n.fileName()), n.markdown(), 0600); err != nil {
+			c.err("unable to write note %d: %v", n.Id, err)
+			return
+		}
+	}
+	c.info("exported %d notes to %s", len(notes), path)
+}
+
+// importNotes uploads notes from a directory of markdown files, a single
+// markdown file, or an archive written by notes/export --passphrase.  Every
+// note is created anew, oldest first, so they get new ids.
+func (c *Client) importNotes(args []string) {
+	if len(args) != 1 {
+		c.err("notes/import takes a directory, a markdown file or a note archive")
+		return
+	}
+	notes, err := c.readNoteFiles(args[0])
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i].Id < notes[j].Id })
+
+	for i, n := range notes {
+		note, err := c.encryptNote(n.Title, []byte(n.Body))
+		if err != nil {
+			c.err("%v", err)
+			return
+		}
+		p, err := c.sendRequest(note)
+		if err != nil {
+			c.err("error sending note: %v", err)
+			return
+		}
+		switch v := (<-p).(type) {
+		case *Bool:
+		case *ErrorDoc:
+			c.err("imported %d of %d notes; error saving %q: %v", i, len(notes), n.Title, v.Error())
+			return
+		default:
+			c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+			return
+		}
+	}
+	c.info("imported %d notes", len(notes))
+}
+
+func (c *Client) readNoteFiles(path string) ([]exportedNote, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	if fi.IsDir() {
+		if paths, err = filepath.Glob(filepath.Join(path, "*.md")); err != nil {
+			return nil, err
+		}
+	} else {
+		paths = []string{path}
+	}
+
+	var notes []exportedNote
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() && isNoteArchive(b) {
+			passphrase, err := c.readPassphrase("passphrase: ")
+			if err != nil {
+				return nil, err
+			}
+			return openNotes(b, passphrase)
+		}
+		n, err := parseNoteFile(p, b)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, *n)
+	}
+	return notes, nil
+}
+
 // ------------------------------------------------------------------------------
 // key functions
 // ------------------------------------------------------------------------------
@@ -417,7 +866,11 @@ func (c *Client) fetchKey(args []string) {
 		c.err("keys/get takes exactly one arg")
 		return
 	}
-	req := KeyRequest(args[0])
+	c.requestKey(c.book.resolve(args[0]))
+}
+
+func (c *Client) requestKey(nick string) {
+	req := KeyRequest(nick)
 	p, err := c.sendRequest(req)
 	if err != nil {
 		c.err("couldn't send key request: %v", err)
@@ -426,6 +879,10 @@ func (c *Client) fetchKey(args []string) {
 	res := <-p
 	switch v := res.(type) {
 	case *KeyResponse:
+		if err := c.checkPin(v.Nick, &v.Key); err != nil {
+			c.err("%v", err)
+			break
+		}
 		c.saveKey(v.Nick, v.Key)
 	case *ErrorDoc:
 		c.err("error fetching key: %v", v.Error())
@@ -446,7 +903,7 @@ func (c *Client) getKey(nick string) (*rsa.PublicKey, error) {
 	if key, ok := c.keyStore[nick]; ok {
 		return &key, nil
 	}
-	c.fetchKey([]string{nick})
+	c.requestKey(nick)
 	if key, ok := c.keyStore[nick]; ok {
 		return &key, nil
 	}
@@ -474,7 +931,7 @@ func (c *Client) sendMessage(args []string) {
 		c.err("send message requires exactly 1 arg, saw %d", len(args))
 		return
 	}
-	to := args[0]
+	to := c.book.resolve(args[0])
 
 	c.info("fetching key...")
 	pkey, err := c.getKey(to)
@@ -530,18 +987,62 @@ func (c *Client) sendMessage(args []string) {
 	c.renderLine()
 }
 
+// listMessages lists recent messages, newest first, leaving out archived
+// ones.  --since 2d lists everything received in the last two days, --oldest
+// lists oldest first, --unread and --starred list only the messages that are
+// unread, or starred, and --archived lists archived messages instead.
 func (c *Client) listMessages(args []string) {
 	r := &ListMessages{N: 10}
+	oldest := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--unread":
+			r.Unread = true
+		case "--starred":
+			r.Starred = true
+		case "--archived":
+			r.Archived = true
+		case "--since":
+			if i+1 == len(args) {
+				c.err("--since needs an age, like 2d")
+				return
+			}
+			i++
+			age, err := parseAge(args[i])
+			if err != nil {
+				c.err("%v", err)
+				return
+			}
+			r.Since = time.Now().Add(-age).UTC()
+			r.N = maxListMessages
+		case "--oldest":
+			oldest = true
+		default:
+			c.err("msg/list takes --since $age, --oldest, --unread, --starred and --archived, not %s", args[i])
+			return
+		}
+	}
 	p, err := c.sendRequest(r)
 	if err != nil {
 		c.err("%v", err)
+		return
 	}
 
-	writeMessageId := func(id int, from string) {
+	writeMessageId := func(id int, from string, received time.Time, flags MessageFlags) {
 		c.mu.Lock()
 		defer c.mu.Unlock()
 		c.trunc()
-		fmt.Printf("%d\t%s\n", id, from)
+		var labels []string
+		if !flags.Read {
+			labels = append(labels, "unread")
+		}
+		if flags.Starred {
+			labels = append(labels, "starred")
+		}
+		if flags.Archived {
+			labels = append(labels, "archived")
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\n", id, from, ago(received, time.Now()), strings.Join(labels, ", "))
 		c.renderLine()
 	}
 
@@ -551,7 +1052,20 @@ func (c *Client) listMessages(args []string) {
 		c.err("error getting message list: %v", v.Error())
 		c.renderLine()
 	case *ListMessagesResponse:
-		for _, item := range *v {
+		items := *v
+		// ids follow the order messages were stored in, which for messages
+		// merged in from an archive isn't the order they were received in.
+		sort.SliceStable(items, func(i, j int) bool {
+			a, b := items[i], items[j]
+			if oldest {
+				a, b = b, a
+			}
+			if !a.Received.Equal(b.Received) {
+				return a.Received.After(b.Received)
+			}
+			return a.Id > b.Id
+		})
+		for _, item := range items {
 			key, err := c.rsaDecrypt(item.Key)
 			if err != nil {
 				c.err("unable to read aes key: %v", err)
@@ -562,7 +1076,13 @@ func (c *Client) listMessages(args []string) {
 				c.err("unable to read message sender: %v", err)
 				return
 			}
-			writeMessageId(item.Id, string(from))
+			// From is whatever the sender wrote; Sender is who the server
+			// says they are.
+			name := strings.TrimRight(string(from), " ")
+			if canon, err := canonicalNick(name); item.Sender != "" && (err != nil || canon != item.Sender) {
+				name = fmt.Sprintf("%s (sent by %s)", name, item.Sender)
+			}
+			writeMessageId(item.Id, name, item.Received, item.MessageFlags)
 		}
 	default:
 		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
@@ -632,6 +1152,345 @@ func (c *Client) getMessage(args []string) {
 	}
 }
 
+// messageFlagCommands are the msg/ commands that set a flag, and what each
+// one sets.  Each flag is independent, so starring a message leaves it
+// unread, and archiving it leaves its star.
+var messageFlagCommands = map[string]struct {
+	flag string
+	on   bool
+	done string
+}{
+	"read":      {flagRead, true, "read"},
+	"unread":    {flagRead, false, "unread"},
+	"archive":   {flagArchived, true, "archived"},
+	"unarchive": {flagArchived, false, "unarchived"},
+	"star":      {flagStarred, true, "starred"},
+	"unstar":    {flagStarred, false, "unstarred"},
+}
+
+// setMessageFlag handles msg/read, msg/unread, msg/archive, msg/unarchive,
+// msg/star and msg/unstar.
+func (c *Client) setMessageFlag(cmd string, args []string) {
+	if len(args) != 1 {
+		c.err("msg/%s takes exactly 1 argument: the id of a message", cmd)
+		return
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		c.err("that doesn't look like an int: %v", err)
+		return
+	}
+	set := messageFlagCommands[cmd]
+	p, err := c.sendRequest(SetMessageFlag{Id: id, Flag: set.flag, On: set.on})
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+	switch v := (<-p).(type) {
+	case *Bool:
+		c.info("message %d is %s", id, set.done)
+	case *ErrorDoc:
+		c.err("error updating message %d: %v", id, v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+// refreshUnread fetches the number of unread messages for the prompt.
+func (c *Client) refreshUnread() {
+	if !c.server.supports(CountMessages{}.Kind()) {
+		return
+	}
+	p, err := c.sendRequest(CountMessages{})
+	if err != nil {
+		c.info("unable to count messages: %v", err)
+		return
+	}
+	switch v := (<-p).(type) {
+	case *MessageCounts:
+		c.rlock.Lock()
+		state := c.state
+		c.rlock.Unlock()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.unread = (*v)["unread"]
+		c.prompt = c.promptFor(state)
+		c.renderLine()
+	case *ErrorDoc:
+		c.info("unable to count messages: %v", v.Error())
+	default:
+		c.info("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+// ------------------------------------------------------------------------------
+// contact functions
+// ------------------------------------------------------------------------------
+
+func (c *Client) updateContact(op string, args []string) {
+	if len(args) != 1 {
+		c.err("contacts/%s takes exactly one arg: a nick", op)
+		return
+	}
+	p, err := c.sendRequest(ContactUpdate{Nick: args[0], Op: op})
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+	res := <-p
+	switch v := res.(type) {
+	case *Bool:
+		c.renderLine()
+	case *ErrorDoc:
+		c.err("error updating contacts: %v", v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+func (c *Client) listContacts(args []string) {
+	p, err := c.sendRequest(ListContacts{})
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+	res := <-p
+	switch v := res.(type) {
+	case *ListContactsResponse:
+		c.watchPresence(v.Contacts)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.trunc()
+		if v.ContactsOnly {
+			fmt.Println("\033[90maccepting messages from contacts only\033[0m")
+		}
+		for _, nick := range v.Contacts {
+			switch status := c.getPresence(nick); status {
+			case statusOnline:
+				fmt.Printf("%s\t\033[32m%s\033[0m\n", nick, status)
+			case statusAway:
+				fmt.Printf("%s\t\033[33m%s\033[0m\n", nick, status)
+			case "":
+				fmt.Printf("%s\n", nick)
+			default:
+				fmt.Printf("%s\t\033[90m%s\033[0m\n", nick, status)
+			}
+		}
+		for _, nick := range v.Blocked {
+			fmt.Printf("%s\t\033[31mblocked\033[0m\n", nick)
+		}
+		c.renderLine()
+	case *ErrorDoc:
+		c.err("error listing contacts: %v", v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+func (c *Client) setInboxPolicy(args []string) {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		c.err("contacts/only takes exactly one arg: on or off")
+		return
+	}
+	p, err := c.sendRequest(InboxPolicy{ContactsOnly: args[0] == "on"})
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+	res := <-p
+	switch v := res.(type) {
+	case *Bool:
+		c.renderLine()
+	case *ErrorDoc:
+		c.err("error setting inbox policy: %v", v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+// ------------------------------------------------------------------------------
+// presence functions
+// ------------------------------------------------------------------------------
+
+func (c *Client) setPresence(nick, status string) {
+	c.plock.Lock()
+	defer c.plock.Unlock()
+	if c.presence == nil {
+		c.presence = make(map[string]string, 8)
+	}
+	c.presence[nick] = status
+}
+
+// getPresence returns the last known status of a nick, or an empty string if
+// the nick's status isn't visible to us.
+func (c *Client) getPresence(nick string) string {
+	c.plock.Lock()
+	defer c.plock.Unlock()
+	return c.presence[nick]
+}
+
+// watchPresence subscribes to status changes for the given nicks and records
+// their current status.
+func (c *Client) watchPresence(nicks []string) {
+	if len(nicks) == 0 {
+		return
+	}
+	p, err := c.sendRequest(SubscribePresence{Nicks: nicks})
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+	switch v := (<-p).(type) {
+	case *PresenceList:
+		for _, presence := range *v {
+			c.setPresence(presence.Nick, presence.Status)
+		}
+	case *ErrorDoc:
+		c.err("error subscribing to presence: %v", v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+func (c *Client) publishPresence(args []string) {
+	if len(args) != 1 || !validStatus(args[0]) {
+		c.err("presence/set takes exactly one arg: online, away or offline")
+		return
+	}
+	p, err := c.sendRequest(SetPresence{Status: args[0]})
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+	switch v := (<-p).(type) {
+	case *Presence:
+		c.status = v.Status
+		c.info("you are %s", v.Status)
+		c.renderLine()
+	case *ErrorDoc:
+		c.err("error setting presence: %v", v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+func (c *Client) hidePresence(args []string) {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		c.err("presence/hide takes exactly one arg: on or off")
+		return
+	}
+	p, err := c.sendRequest(PresencePrivacy{Hidden: args[0] == "on"})
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+	switch v := (<-p).(type) {
+	case *Bool:
+		c.renderLine()
+	case *ErrorDoc:
+		c.err("error setting presence privacy: %v", v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+// ------------------------------------------------------------------------------
+// admin functions
+// ------------------------------------------------------------------------------
+
+func (c *Client) usageReport(args []string) {
+	p, err := c.sendRequest(UsageRequest{})
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+
+	res := <-p
+	switch v := res.(type) {
+	case *UsageResponse:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.trunc()
+		for _, item := range *v {
+			fmt.Printf("%s\t%d items\t%d bytes\n", item.Nick, item.Items, item.Bytes)
+		}
+		c.renderLine()
+	case *ErrorDoc:
+		c.err("error getting usage report: %v", v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+func (c *Client) exportUser(args []string) {
+	if len(args) != 2 {
+		c.err("export requires a nick and a file to write to")
+		return
+	}
+	nick, path := args[0], args[1]
+	p, err := c.sendRequest(ExportUser{Nick: c.book.resolve(nick)})
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+
+	switch v := (<-p).(type) {
+	case *Archive:
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			c.err("unable to encode archive: %v", err)
+			return
+		}
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			c.err("unable to write archive: %v", err)
+			return
+		}
+		c.info("exported %s to %s: %d notes, %d messages", v.Nick, path, len(v.Notes), len(v.Messages))
+	case *ErrorDoc:
+		c.err("error exporting %s: %v", nick, v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
+func (c *Client) importUser(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		c.err("import requires an archive file, and optionally fail, merge or replace")
+		return
+	}
+	req := ImportUser{OnConflict: "fail"}
+	if len(args) == 2 {
+		req.OnConflict = args[1]
+	}
+	raw, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		c.err("unable to read archive: %v", err)
+		return
+	}
+	if err := json.Unmarshal(raw, &req.Archive); err != nil {
+		c.err("unable to parse archive: %v", err)
+		return
+	}
+	p, err := c.sendRequest(req)
+	if err != nil {
+		c.err("%v", err)
+		return
+	}
+
+	switch v := (<-p).(type) {
+	case *Bool:
+		c.info("imported %s: %d notes, %d messages", req.Archive.Nick, len(req.Archive.Notes), len(req.Archive.Messages))
+	case *ErrorDoc:
+		c.err("error importing %s: %v", args[0], v.Error())
+	default:
+		c.err("received response of unexpected type: %v", reflect.TypeOf(v))
+	}
+}
+
 func (c *Client) readTextBlock() ([]byte, error) {
 	// god dammit what have i gotten myself into
 	var buf bytes.Buffer
@@ -675,6 +1534,40 @@ func (c *Client) readTextBlock() ([]byte, error) {
 	}
 }
 
+// readPassphrase reads a line from the terminal without echoing it.
+func (c *Client) readPassphrase(prompt string) ([]byte, error) {
+	fmt.Print("\033[1K") // clear to beginning of current line
+	fmt.Print("\r")      // move to beginning of current line
+	fmt.Print(prompt)
+	defer fmt.Print("\r\n")
+
+	var buf []rune
+	in := bufio.NewReader(os.Stdin)
+	for {
+		r, _, err := in.ReadRune()
+		if err != nil {
+			return nil, fmt.Errorf("error reading passphrase: %v", err)
+		}
+		if unicode.IsGraphic(r) {
+			buf = append(buf, r)
+			continue
+		}
+		switch r {
+		case 13: // enter
+			if len(buf) == 0 {
+				return nil, fmt.Errorf("passphrase can't be empty")
+			}
+			return []byte(string(buf)), nil
+		case 127: // backspace
+			if len(buf) > 0 {
+				buf = buf[:len(buf)-1]
+			}
+		case 3, 4: // ctrl+c, ctrl+d
+			return nil, fmt.Errorf("cancelled")
+		}
+	}
+}
+
 func (c *Client) eof() {
 	fmt.Print("\033[1K") // clear to beginning of current line
 	fmt.Print("\r")      // move to beginning of current line
@@ -800,7 +1693,11 @@ func connect() {
 		done:        make(chan interface{}),
 		line:        make([]rune, 0, 32),
 		keyStore:    make(map[string]rsa.PublicKey, 8),
-		outstanding: make(map[int]chan request),
+		outstanding: make(map[int]*pending),
+	}
+	client.prompt = client.promptFor(stateConnecting)
+	if err := client.loadBook(); err != nil {
+		exit(1, "%v", err)
 	}
 	client.run()
 }
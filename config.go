@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A config file holds server settings, one per line, as a flag name and its
+// value separated by whitespace or an equals sign:
+//
+//	# limits
+//	quota-bytes 134217728
+//	admins = alice,bob
+//
+// Flags given on the command line take precedence over the file.  Sending the
+// server SIGHUP re-reads the file and applies any settings in reloadable.
+
+// reloadable are the settings that can change while the server is running.
+// Anything else takes a restart.
+var reloadable = map[string]bool{
+	"max-envelope":    true,
+	"max-body":        true,
+	"quota-bytes":     true,
+	"quota-items":     true,
+	"admins":          true,
+	"conn-limit":      true,
+	"nick-limit":      true,
+	"pair-limit":      true,
+	"auth-limit":      true,
+	"auth-fail-limit": true,
+}
+
+// configLock guards the reloadable settings.  They're read through
+// currentSettings and rateLimit.current, which copy them with the lock held
+// for reading, so that a reload never has to wait for a slow request.
+var configLock sync.RWMutex
+
+// settings are the reloadable settings, other than the rate limits.
+type settings struct {
+	maxEnvelope int
+	maxBody     int
+	quotaBytes  int64
+	quotaItems  int
+	admins      string
+}
+
+// currentSettings returns a copy of the reloadable settings as they are now.
+func currentSettings() settings {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	return settings{
+		maxEnvelope: options.maxEnvelope,
+		maxBody:     options.maxBody,
+		quotaBytes:  options.quotaBytes,
+		quotaItems:  options.quotaItems,
+		admins:      options.admins,
+	}
+}
+
+// loadedConfig is the config file as it was read at startup, for spotting
+// changes to settings that can't be reloaded.  commandLine is the set of flags
+// given on the command line, which the config file never overrides.
+var (
+	loadedConfig map[string]string
+	commandLine  map[string]bool
+)
+
+// readConfig parses a config file into flag names and values.
+func readConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open config file: %v", err)
+	}
+	defer f.Close()
+
+	settings := make(map[string]string, 16)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: setting %q has no value", path, n, line)
+		}
+		name := line[:i]
+		value := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[i:]), "="))
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: no such setting: %s", path, n, name)
+		}
+		settings[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
+	}
+	return settings, nil
+}
+
+// loadConfig applies every setting in the config file that wasn't given on
+// the command line.  It's used once, at startup.
+func loadConfig() error {
+	if options.config == "" {
+		return nil
+	}
+	settings, err := readConfig(options.config)
+	if err != nil {
+		return err
+	}
+	// flag.Visit has to be called before any flags are set from the file,
+	// since it can't tell the two apart.
+	commandLine = make(map[string]bool, 8)
+	flag.Visit(func(f *flag.Flag) { commandLine[f.Name] = true })
+	for name, value := range settings {
+		if commandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("bad value for %s in config file: %v", name, err)
+		}
+	}
+	loadedConfig = settings
+	return nil
+}
+
+// reloadConfig re-reads the config file and applies the reloadable settings
+// in it.  Changes to any other setting are reported and ignored, and settings
+// removed from the file keep their current values.  Nothing is applied unless
+// the whole file is valid.
+func reloadConfig() error {
+	if options.config == "" {
+		return fmt.Errorf("no config file to reload")
+	}
+	settings, err := readConfig(options.config)
+	if err != nil {
+		return err
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	// check every value before changing anything, so a typo can't leave the
+	// server half reconfigured.
+	for name, value := range settings {
+		if commandLine[name] || !reloadable[name] {
+			continue
+		}
+		if err := validateFlag(flag.Lookup(name), value); err != nil {
+			return fmt.Errorf("bad value for %s in config file: %v", name, err)
+		}
+	}
+
+	for name, value := range settings {
+		f := flag.Lookup(name)
+		switch {
+		case commandLine[name]:
+		case !reloadable[name]:
+			if old, ok := loadedConfig[name]; !ok || old != value {
+				error_log.Printf("config: %s cannot be changed without a restart", name)
+			}
+		case f.Value.String() != value:
+			flag.Set(name, value)
+			info_log.Printf("config: %s is now %s", name, f.Value)
+		}
+	}
+	return nil
+}
+
+// validateFlag checks that a value would be accepted by a flag, leaving the
+// flag as it was.  The caller must hold configLock.
+func validateFlag(f *flag.Flag, value string) error {
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		return err
+	}
+	return f.Value.Set(old)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	contactsPrefix = "contacts/"
+	blockedPrefix  = "blocked/"
+	policyKey      = "inbox_policy"
+)
+
+// ContactUpdate adds a nick to or removes a nick from the user's contact list
+// or block list.  Op is one of add, remove, block or unblock.
+type ContactUpdate struct {
+	Nick string
+	Op   string
+}
+
+func (c ContactUpdate) Kind() string {
+	return "update-contact"
+}
+
+func init() { registerRequestType(func() request { return new(ContactUpdate) }) }
+
+type ListContacts struct{}
+
+func (l ListContacts) Kind() string {
+	return "list-contacts"
+}
+
+func init() { registerRequestType(func() request { return new(ListContacts) }) }
+
+type ListContactsResponse struct {
+	Contacts     []string
+	Blocked      []string
+	ContactsOnly bool
+}
+
+func (l ListContactsResponse) Kind() string {
+	return "list-contacts-response"
+}
+
+func init() { registerRequestType(func() request { return new(ListContactsResponse) }) }
+
+// InboxPolicy controls who is allowed to put messages in a user's inbox.  With
+// ContactsOnly set, only nicks on the user's contact list may send messages.
+// Blocked nicks are always rejected.
+type InboxPolicy struct {
+	ContactsOnly bool
+}
+
+func (p InboxPolicy) Kind() string {
+	return "set-inbox-policy"
+}
+
+func init() { registerRequestType(func() request { return new(InboxPolicy) }) }
+
+func (db *userdb) hasKey(key string) (bool, error) {
+	_, err := db.Get([]byte(key))
+	switch err {
+	case nil:
+		return true, nil
+	case errNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (db *userdb) isContact(nick string) (bool, error) {
+	return db.hasKey(contactsPrefix + nick)
+}
+
+func (db *userdb) isBlocked(nick string) (bool, error) {
+	return db.hasKey(blockedPrefix + nick)
+}
+
+func (db *userdb) inboxPolicy() (*InboxPolicy, error) {
+	var policy InboxPolicy
+	b, err := db.Get([]byte(policyKey))
+	switch err {
+	case nil:
+		if err := json.Unmarshal(b, &policy); err != nil {
+			return nil, fmt.Errorf("unable to parse inbox policy: %v", err)
+		}
+	case errNotFound:
+	default:
+		return nil, fmt.Errorf("unable to read inbox policy: %v", err)
+	}
+	return &policy, nil
+}
+
+// accepts checks the user's block list and inbox policy to see whether a
+// message from the given sender should be delivered.  The sender must be the
+// authenticated nick of the connection, never a value taken from the message
+// itself.
+func (db *userdb) accepts(sender string) error {
+	blocked, err := db.isBlocked(sender)
+	if err != nil {
+		return fmt.Errorf("unable to read block list: %v", err)
+	}
+	if blocked {
+		return errorf(codeRejected, "recipient is not accepting messages from you")
+	}
+
+	policy, err := db.inboxPolicy()
+	if err != nil {
+		return err
+	}
+	if !policy.ContactsOnly {
+		return nil
+	}
+	ok, err := db.isContact(sender)
+	if err != nil {
+		return fmt.Errorf("unable to read contact list: %v", err)
+	}
+	if !ok {
+		return errorf(codeRejected, "recipient only accepts messages from contacts")
+	}
+	return nil
+}
+
+// listNicks returns the nicks stored under a prefix such as contacts/ or
+// blocked/.
+func (db *userdb) listNicks(prefix string) ([]string, error) {
+	it := db.NewIterator([]byte(prefix))
+	defer it.Release()
+
+	nicks := make([]string, 0, 8)
+	for it.Next() {
+		nicks = append(nicks, strings.TrimPrefix(string(it.Key()), prefix))
+	}
+	if err := it.Error(); err != nil {
+		return nil, fmt.Errorf("unable to list %s: %v", prefix, err)
+	}
+	// sealed keys aren't stored in order.
+	sort.Strings(nicks)
+	return nicks, nil
+}
@@ -5,24 +5,27 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/opt"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	"strings"
 	"sync"
 )
 
 var (
-	openDBs    = make(map[string]userdb, 32)
+	openDBs    = make(map[string]*userdb, 32)
 	dbopenlock sync.Mutex
 )
 
 type userdb struct {
-	*leveldb.DB
+	store
+	usageLock sync.Mutex
+	usage     *diskUsage
+
+	// seqLock serializes id allocation and other reads-then-writes; see
+	// appendItem.
+	seqLock sync.Mutex
 }
 
 func (db *userdb) getPublicKey() (*rsa.PublicKey, error) {
-	val, err := db.Get([]byte("public_key"), nil)
+	val, err := db.Get([]byte("public_key"))
 	if err != nil {
 		return nil, fmt.Errorf("unable to get public key: %v", err)
 	}
@@ -34,30 +37,124 @@ func (db *userdb) getPublicKey() (*rsa.PublicKey, error) {
 	return &key, nil
 }
 
-func (db *userdb) nextKey(prefix string) (string, error) {
-	r := util.BytesPrefix([]byte(prefix))
-	it := db.NewIterator(r, nil)
-	defer it.Release()
+// claimKey saves the public key of a new user.  Two clients can be challenged
+// for the same new nick at once, so the key is only saved if nobody else has
+// saved one in the meantime.
+func (db *userdb) claimKey(key *rsa.PublicKey) error {
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
 
-	id := 0
-	if it.Last() {
-		key := it.Key()
-		id_s := strings.TrimPrefix(string(key), prefix)
-		lastId, err := decodeInt(id_s)
-		if err != nil {
-			return "0", fmt.Errorf("error getting note id: %v", err)
+	switch _, err := db.Get([]byte("public_key")); err {
+	case nil:
+		return fmt.Errorf("client presented wrong auth key")
+	case errNotFound:
+	default:
+		return fmt.Errorf("unable to read public key: %v", err)
+	}
+	keybytes, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("cannot marshal auth key: %v", err)
+	}
+	if err := db.Put([]byte("public_key"), keybytes); err != nil {
+		return fmt.Errorf("cannot write public key to database: %v", err)
+	}
+	return nil
+}
+
+// seqPrefix starts the key of each id counter: "seq/messages/" holds the
+// next id to be handed out under "messages/".
+const seqPrefix = "seq/"
+
+// appendItem stores a quota-counted item under the next id in a prefix's
+// series and returns its key.  The counter and the item are written together
+// in one batch, under the database's seqLock, so that two writers can never
+// be given the same id.
+func (db *userdb) appendItem(prefix string, val []byte) (string, error) {
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+
+	id, err := db.nextID(prefix)
+	if err != nil {
+		return "", fmt.Errorf("unable to allocate id under %s: %v", prefix, err)
+	}
+	key := prefix + encodeInt(id)
+	if err := db.reserve(key, val); err != nil {
+		return "", err
+	}
+	var b batch
+	b.Put([]byte(seqPrefix+prefix), []byte(encodeInt(id+1)))
+	b.Put([]byte(key), val)
+	if err := db.Write(&b); err != nil {
+		db.release(key, val)
+		return "", err
+	}
+	return key, nil
+}
+
+// putItem stores a quota-counted item under a fixed key.  A new item is
+// charged against both quotas; replacing one is charged the difference in
+// size.
+func (db *userdb) putItem(key string, val []byte) error {
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+
+	old, err := db.Get([]byte(key))
+	switch err {
+	case nil:
+		delta := int64(len(val) - len(old))
+		if err := db.grow(delta); err != nil {
+			return err
+		}
+		if err := db.Put([]byte(key), val); err != nil {
+			db.resize(-delta)
+			return err
 		}
-		id = lastId + 1
+		return nil
+	case errNotFound:
+		if err := db.reserve(key, val); err != nil {
+			return err
+		}
+		if err := db.Put([]byte(key), val); err != nil {
+			db.release(key, val)
+			return err
+		}
+		return nil
+	default:
+		return err
+	}
+}
+
+// nextID reads the counter for a prefix.  Databases written before there
+// were counters don't have one, so then the series continues from its last
+// key.  The caller must hold seqLock.
+func (db *userdb) nextID(prefix string) (int, error) {
+	val, err := db.Get([]byte(seqPrefix + prefix))
+	switch err {
+	case nil:
+		return decodeInt(string(val))
+	case errNotFound:
+	default:
+		return 0, err
+	}
+
+	it := db.NewIterator([]byte(prefix))
+	defer it.Release()
+
+	if !it.Last() {
+		return 0, it.Error()
 	}
-	return fmt.Sprintf("%s%s", prefix, encodeInt(id)), nil
+	lastId, err := decodeInt(strings.TrimPrefix(string(it.Key()), prefix))
+	if err != nil {
+		return 0, fmt.Errorf("bad key %s: %v", it.Key(), err)
+	}
+	return lastId + 1, nil
 }
 
 // iterates through a range of values, starting with a prefix, parsing the
 // lexnum part on each key, and calling the callback for each value with the
 // value's associated number in its lexical series
 func (db *userdb) collect(prefix []byte, n int, fn func(n int, v []byte) error) error {
-	r := util.BytesPrefix(prefix)
-	it := db.NewIterator(r, nil)
+	it := db.NewIterator(prefix)
 	defer it.Release()
 
 	var step func() bool
@@ -86,26 +183,58 @@ func (db *userdb) collect(prefix []byte, n int, fn func(n int, v []byte) error)
 }
 
 func getUserDB(nick string, create bool) (*userdb, error) {
-	if db, ok := openDBs[nick]; ok {
-		return &db, nil
+	nick, err := canonicalNick(nick)
+	if err != nil {
+		return nil, err
 	}
+	dbopenlock.Lock()
+	defer dbopenlock.Unlock()
 
-	opts := &opt.Options{
-		ErrorIfMissing: !create,
+	if db, ok := openDBs[nick]; ok {
+		return db, nil
+	}
+	db, err := openUserDB(nick, create)
+	if err != nil {
+		return nil, err
 	}
-	path := fmt.Sprintf("./%s.db", nick)
-	conn, err := leveldb.OpenFile(path, opts)
+	report, err := db.migrate(false)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open db file at %s: %v", path, err)
+		db.Close()
+		return nil, fmt.Errorf("unable to migrate database for %s: %v", nick, err)
+	}
+	if len(report.Changed) > 0 {
+		info_log.Printf("migrated database for %s: %v", nick, report)
 	}
-	info_log.Printf("opened database file: %s", path)
+	openDBs[nick] = db
+	return db, nil
+}
 
+// openUserDB opens a user's database, sealed if there's a master key.  Most
+// callers want getUserDB, which also keeps it open and up to date.
+func openUserDB(nick string, create bool) (*userdb, error) {
+	conn, err := openUserStore(nick, create)
+	if err != nil {
+		return nil, err
+	}
+	if masterSealer != nil {
+		conn = &sealedStore{store: conn, sealer: masterSealer}
+	}
+	return &userdb{store: conn}, nil
+}
+
+// closeDBs closes every open user database.  It's used when the server shuts
+// down.
+func closeDBs() {
 	dbopenlock.Lock()
 	defer dbopenlock.Unlock()
 
-	db := userdb{conn}
-	openDBs[nick] = db
-	return &db, nil
+	for nick, db := range openDBs {
+		if err := db.Close(); err != nil {
+			error_log.Printf("unable to close database for %s: %v", nick, err)
+		}
+		delete(openDBs, nick)
+	}
+	closeShared()
 }
 
 func getUserKey(nick string) (*rsa.PublicKey, error) {
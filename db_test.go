@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowStore widens the gap between reading and writing an id, so that
+// concurrent writers reliably overlap even on a single cpu.
+type slowStore struct {
+	store
+}
+
+func (s slowStore) Get(key []byte) ([]byte, error) {
+	val, err := s.store.Get(key)
+	time.Sleep(time.Millisecond)
+	return val, err
+}
+
+func (s slowStore) NewIterator(prefix []byte) iterator {
+	it := s.store.NewIterator(prefix)
+	time.Sleep(time.Millisecond)
+	return it
+}
+
+// racyAppend is how items were stored before appendItem: find the last id in
+// use, then write the item after it, with nothing to stop another writer
+// finding the same id in between.
+func racyAppend(db *userdb, prefix string, val []byte) error {
+	it := db.NewIterator([]byte(prefix))
+	id := 0
+	if it.Last() {
+		last, err := decodeInt(strings.TrimPrefix(string(it.Key()), prefix))
+		if err != nil {
+			it.Release()
+			return err
+		}
+		id = last + 1
+	}
+	it.Release()
+	return db.Put([]byte(prefix+encodeInt(id)), val)
+}
+
+// appendConcurrently stores n messages at once with the given append func
+// and reports how many were stored.
+func appendConcurrently(t *testing.T, db *userdb, n int, appendFn func(val []byte) error) int {
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			if err := appendFn([]byte(fmt.Sprintf("message %d", i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	count := 0
+	it := db.NewIterator([]byte("messages/"))
+	for it.Next() {
+		count++
+	}
+	it.Release()
+	return count
+}
+
+func newAppendTestDB(t *testing.T, name string) *userdb {
+	mem, err := openMemStore(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		memStores.Lock()
+		delete(memStores.stores, name)
+		memStores.Unlock()
+	})
+	return &userdb{store: slowStore{mem}}
+}
+
+// TestConcurrentAppend sends many messages to one user at once.  Before ids
+// came from a counter, concurrent senders could read the same last key, be
+// given the same id, and overwrite each other's messages.
+func TestConcurrentAppend(t *testing.T) {
+	info_log, error_log = log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0)
+	const n = 100
+
+	// first show that the old way loses messages, so that this test can
+	// tell the difference.
+	racy := newAppendTestDB(t, "racy-append-test")
+	stored := appendConcurrently(t, racy, n, func(val []byte) error {
+		return racyAppend(racy, "messages/", val)
+	})
+	if stored == n {
+		t.Errorf("reading the last id and then writing stored all %d messages; the race isn't being exercised", n)
+	}
+
+	db := newAppendTestDB(t, "append-test")
+
+	// a message from before there were counters, which the counter has to
+	// start after.
+	if err := db.Put([]byte("messages/"+encodeInt(0)), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]bool, n)
+	stored = appendConcurrently(t, db, n, func(val []byte) error {
+		key, err := db.appendItem("messages/", val)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if seen[key] {
+			t.Errorf("id %s was handed out twice", key)
+		}
+		seen[key] = true
+		return nil
+	})
+	if seen["messages/"+encodeInt(0)] {
+		t.Errorf("the existing message's id was handed out again")
+	}
+	if stored != n+1 {
+		t.Errorf("expected %d messages, saw %d", n+1, stored)
+	}
+}
+
+// TestPutItemQuota checks that blobs are charged against the quotas, and that
+// replacing one is only charged the difference.
+func TestPutItemQuota(t *testing.T) {
+	info_log, error_log = log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0)
+	mem, err := openMemStore("put-item-test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		memStores.Lock()
+		delete(memStores.stores, "put-item-test")
+		memStores.Unlock()
+	}()
+	db := &userdb{store: mem}
+
+	oldBytes, oldItems := options.quotaBytes, options.quotaItems
+	defer func() { options.quotaBytes, options.quotaItems = oldBytes, oldItems }()
+	options.quotaBytes, options.quotaItems = 100, 2
+
+	if err := db.putItem("blobs/a", make([]byte, 40)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.putItem("blobs/a", make([]byte, 80)); err != nil {
+		t.Errorf("replacing a blob was charged for the whole blob: %v", err)
+	}
+	if err := db.putItem("blobs/a", make([]byte, 100)); err == nil {
+		t.Errorf("a blob grew past the byte quota")
+	}
+	if err := db.putItem("blobs/a", make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.putItem("blobs/b", make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.putItem("blobs/c", make([]byte, 10)); err == nil {
+		t.Errorf("a third blob was stored past the item quota")
+	}
+
+	u, err := db.getUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := diskUsage{Bytes: int64(len("blobs/a") + 10 + len("blobs/b") + 10), Items: 2}
+	if u != want {
+		t.Errorf("expected usage %+v, saw %+v", want, u)
+	}
+	db.usage = nil
+	if u, _ := db.getUsage(); u != want {
+		t.Errorf("recounted usage %+v doesn't match the counters %+v", u, want)
+	}
+}
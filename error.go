@@ -1,15 +1,82 @@
 package main
 
-import ()
+import (
+	"encoding/json"
+	"fmt"
+)
 
-type ErrorDoc string
+// machine-readable error codes carried in an ErrorDoc.  An empty code means
+// the error has no particular category.
+const (
+	codeTooLarge        = "too-large"
+	codeQuotaExceeded   = "quota-exceeded"
+	codeForbidden       = "forbidden"
+	codeRateLimited     = "rate-limited"
+	codeUnauthenticated = "unauthenticated"
+	codeRejected        = "rejected"
+	codeVersionMismatch = "version-mismatch"
+	codeUnsupported     = "unsupported"
+	codeDisconnected    = "disconnected"
+	codeTimeout         = "timeout"
+	codeCanceled        = "canceled"
+	codeInvalidNick     = "invalid-nick"
+)
+
+type ErrorDoc struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+
+	// RetryAfter is the number of seconds a client should wait before
+	// retrying a request that was rejected because of a rate limit.
+	RetryAfter float64 `json:"retry_after,omitempty"`
+}
+
+// errorf creates an ErrorDoc with the given code.  ErrorDoc values satisfy
+// the error interface, so server handlers can return them directly and have
+// the code survive all the way back to the client.
+func errorf(code string, template string, args ...interface{}) ErrorDoc {
+	return ErrorDoc{Code: code, Message: fmt.Sprintf(template, args...)}
+}
+
+// errorDoc converts an arbitrary error into an ErrorDoc, preserving the code
+// if the error is already an ErrorDoc.
+func errorDoc(err error) ErrorDoc {
+	if doc, ok := err.(ErrorDoc); ok {
+		return doc
+	}
+	return ErrorDoc{Message: err.Error()}
+}
 
 func (e ErrorDoc) Kind() string {
 	return "error"
 }
 
 func (e ErrorDoc) Error() string {
-	return string(e)
+	msg := e.Message
+	if e.Code != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, e.Code)
+	}
+	if e.RetryAfter > 0 {
+		msg = fmt.Sprintf("%s, retry after %.1fs", msg, e.RetryAfter)
+	}
+	return msg
+}
+
+// UnmarshalJSON accepts the older bare-string error documents as well as the
+// structured form.
+func (e *ErrorDoc) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*e = ErrorDoc{Message: s}
+		return nil
+	}
+	type plain ErrorDoc
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*e = ErrorDoc(p)
+	return nil
 }
 
 func init() { registerRequestType(func() request { return new(ErrorDoc) }) }
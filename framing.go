@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// the framed protocol starts with a header of frameMagic followed by a
+// single version byte.  Every envelope after that is a four byte big-endian
+// length followed by that many bytes of json.
+const (
+	frameMagic   = "WHSP"
+	frameVersion = 1
+)
+
+// a codec reads and writes envelopes on a connection.  Implementations need
+// not be safe for concurrent writes; callers serialize them.
+type codec interface {
+	readEnvelope() (*Envelope, error)
+	writeEnvelope(e *Envelope) error
+}
+
+// a transport is the connection underneath a codec: a tcp connection, or a
+// websocket.
+type transport interface {
+	RemoteAddr() net.Addr
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// frameError is a problem with a single envelope that doesn't affect the
+// rest of the stream.  The offending envelope has been consumed, so the
+// reader can keep going.
+type frameError struct {
+	err error
+}
+
+func (f frameError) Error() string {
+	return fmt.Sprintf("bad frame: %v", f.err)
+}
+
+// jsonCodec is the legacy framing: bare json objects, back to back, with
+// json.Decoder finding the boundaries between them.
+type jsonCodec struct {
+	dec *json.Decoder
+	w   io.Writer
+}
+
+func newJSONCodec(r io.Reader, w io.Writer) *jsonCodec {
+	return &jsonCodec{dec: json.NewDecoder(r), w: w}
+}
+
+func (j *jsonCodec) readEnvelope() (*Envelope, error) {
+	var env Envelope
+	err := j.dec.Decode(&env)
+	switch err.(type) {
+	case nil:
+		return &env, nil
+	case *json.UnmarshalTypeError:
+		// the decoder has read past the whole value, so we can skip it.
+		return nil, frameError{err}
+	default:
+		// anything else (a syntax error, most likely) leaves the decoder
+		// stuck at the same spot forever; the stream can't continue.
+		return nil, err
+	}
+}
+
+func (j *jsonCodec) writeEnvelope(e *Envelope) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("unable to marshal request envelope: %v", err)
+	}
+	if _, err := j.w.Write(raw); err != nil {
+		return fmt.Errorf("unable to write request: %v", err)
+	}
+	return nil
+}
+
+// frameCodec is the length-prefixed framing.
+type frameCodec struct {
+	r   *bufio.Reader
+	w   io.Writer
+	max int
+}
+
+func newFrameCodec(r *bufio.Reader, w io.Writer) *frameCodec {
+	return &frameCodec{r: r, w: w, max: options.maxFrame}
+}
+
+func (f *frameCodec) readEnvelope() (*Envelope, error) {
+	var size uint32
+	if err := binary.Read(f.r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if f.max > 0 && int64(size) > int64(f.max) {
+		return nil, fmt.Errorf("frame of %d bytes exceeds maximum frame size of %d bytes", size, f.max)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(f.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var env Envelope
+	if err := json.Unmarshal(buf, &env); err != nil {
+		return nil, frameError{err}
+	}
+	return &env, nil
+}
+
+func (f *frameCodec) writeEnvelope(e *Envelope) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("unable to marshal request envelope: %v", err)
+	}
+	if f.max > 0 && len(raw) > f.max {
+		return fmt.Errorf("envelope of %d bytes exceeds maximum frame size of %d bytes", len(raw), f.max)
+	}
+	// the length and the payload go out in a single write, so a failed
+	// write never leaves a length on the wire without its payload.
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(raw)))
+	buf.Write(raw)
+	if _, err := f.w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write request: %v", err)
+	}
+	return nil
+}
+
+func frameHeader() []byte {
+	return append([]byte(frameMagic), frameVersion)
+}
+
+// readFrameHeader consumes and checks the framed protocol header.
+func readFrameHeader(r io.Reader) error {
+	header := make([]byte, len(frameMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("unable to read frame header: %v", err)
+	}
+	if string(header[:len(frameMagic)]) != frameMagic {
+		return fmt.Errorf("bad frame header %q: peer does not speak the framed protocol", header)
+	}
+	if v := header[len(frameMagic)]; v != frameVersion {
+		return fmt.Errorf("unsupported frame version %d (we speak version %d)", v, frameVersion)
+	}
+	return nil
+}
+
+// acceptCodec sets up the codec for a new server connection.  Framed clients
+// announce themselves by sending the frame header first, and the server
+// echoes it back; anything else is treated as legacy json, if that's
+// allowed.
+func acceptCodec(rw io.ReadWriter) (codec, error) {
+	// a client that connects and says nothing shouldn't hold the connection
+	// open forever.
+	if d, ok := rw.(interface{ SetReadDeadline(time.Time) error }); ok && options.handshakeTimeout > 0 {
+		d.SetReadDeadline(time.Now().Add(options.handshakeTimeout))
+		defer d.SetReadDeadline(time.Time{})
+	}
+	r := bufio.NewReader(rw)
+	peek, err := r.Peek(len(frameMagic))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read from connection: %v", err)
+	}
+	if string(peek) == frameMagic {
+		if err := readFrameHeader(r); err != nil {
+			return nil, err
+		}
+		if _, err := rw.Write(frameHeader()); err != nil {
+			return nil, fmt.Errorf("unable to write frame header: %v", err)
+		}
+		return newFrameCodec(r, rw), nil
+	}
+	if !options.legacyJSON {
+		return nil, fmt.Errorf("client did not send a frame header and legacy json framing is disabled")
+	}
+	return newJSONCodec(r, rw), nil
+}
+
+// dialCodec sets up the codec for a new client connection, according to the
+// framing option.
+func dialCodec(rw io.ReadWriter) (codec, error) {
+	switch options.framing {
+	case "json":
+		return newJSONCodec(rw, rw), nil
+	case "framed":
+		return dialFrameCodec(rw)
+	default:
+		return nil, fmt.Errorf("unknown framing: %s", options.framing)
+	}
+}
+
+// dialFrameCodec sets up the framed protocol on a new client connection.
+func dialFrameCodec(rw io.ReadWriter) (codec, error) {
+	if _, err := rw.Write(frameHeader()); err != nil {
+		return nil, fmt.Errorf("unable to write frame header: %v", err)
+	}
+	r := bufio.NewReader(rw)
+	if err := readFrameHeader(r); err != nil {
+		return nil, err
+	}
+	return newFrameCodec(r, rw), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFramedStream(t *testing.T) {
+	defer func(maxFrame int) { options.maxFrame = maxFrame }(options.maxFrame)
+	options.maxFrame = 1024
+
+	var buf bytes.Buffer
+	w := newFrameCodec(nil, &buf)
+	if err := writeRequest(w, 1, &GetNoteRequest{Id: 3}); err != nil {
+		t.Fatalf("unable to write request: %v", err)
+	}
+
+	// a frame with a sane length but garbage inside should be skipped
+	garbage := []byte("this is not json")
+	binary.Write(&buf, binary.BigEndian, uint32(len(garbage)))
+	buf.Write(garbage)
+
+	if err := writeRequest(w, 2, &ListNotes{N: 10}); err != nil {
+		t.Fatalf("unable to write request: %v", err)
+	}
+
+	// a frame that's too big should end the stream
+	binary.Write(&buf, binary.BigEndian, uint32(1<<20))
+
+	envelopes := make(chan Envelope)
+	errors := make(chan error)
+	done := make(chan interface{})
+	go stream(newFrameCodec(bufio.NewReader(&buf), nil), envelopes, errors, done, nil)
+
+	var ids []int
+	var errs []error
+	for {
+		select {
+		case e := <-envelopes:
+			ids = append(ids, e.Id)
+		case err := <-errors:
+			errs = append(errs, err)
+		case <-done:
+			if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+				t.Errorf("expected envelopes 1 and 2, saw %v", ids)
+			}
+			if len(errs) != 2 {
+				t.Fatalf("expected 2 errors, saw %d: %v", len(errs), errs)
+			}
+			if _, ok := errs[0].(frameError); !ok {
+				t.Errorf("expected bad frame to be skipped, saw %v", errs[0])
+			}
+			if !strings.Contains(errs[1].Error(), "exceeds maximum frame size") {
+				t.Errorf("expected oversized frame to end the stream, saw %v", errs[1])
+			}
+			return
+		}
+	}
+}
+
+func TestJSONStreamSyntaxError(t *testing.T) {
+	r := strings.NewReader(`{"id": 1, "kind": "get-note", "body": {}}{"id": 2, oops`)
+
+	envelopes := make(chan Envelope)
+	errors := make(chan error)
+	done := make(chan interface{})
+	go stream(newJSONCodec(r, nil), envelopes, errors, done, nil)
+
+	seen, errs := 0, 0
+	for {
+		select {
+		case <-envelopes:
+			seen++
+		case <-errors:
+			errs++
+		case <-done:
+			if seen != 1 || errs != 1 {
+				t.Errorf("expected 1 envelope and 1 error, saw %d and %d", seen, errs)
+			}
+			return
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	defer func(d time.Duration) { options.handshakeTimeout = d }(options.handshakeTimeout)
+	options.handshakeTimeout = 20 * time.Millisecond
+
+	// a client that never says anything is given up on.
+	server, client := net.Pipe()
+	defer client.Close()
+	if _, err := acceptCodec(server); err == nil {
+		t.Errorf("accepted a connection that never sent anything")
+	}
+	server.Close()
+
+	// once the handshake is done, the deadline no longer applies.
+	server, client = net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	dialed := make(chan codec)
+	go func() {
+		c, err := dialFrameCodec(client)
+		if err != nil {
+			t.Error(err)
+		}
+		dialed <- c
+	}()
+	c, err := acceptCodec(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := <-dialed
+	time.Sleep(2 * options.handshakeTimeout)
+	go writeRequest(cc, 1, &GetNoteRequest{Id: 3})
+	if _, err := c.readEnvelope(); err != nil {
+		t.Errorf("unable to read after the handshake: %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The http gateway exposes a subset of the protocol as a rest api, for bots
+// and scripts.  It carries exactly what the envelope protocol carries: notes
+// and messages are encrypted and decrypted by the caller, and the gateway
+// only ever sees ciphertext.
+//
+// Every request is signed with the caller's private key.  The signature is
+// rsa pkcs1 v1.5 over the sha-256 of the string
+//
+//	METHOD \n PATH?QUERY \n DATE \n NONCE \n NICK \n hex(sha256(BODY))
+//
+// base64 encoded in the Whisper-Signature header, with the nick, the date
+// (rfc 3339) and a random nonce in the Whisper-Nick, Whisper-Date and
+// Whisper-Nonce headers.  The signature alone can't tell two identical
+// requests in the same second apart, so it's the nonce that keeps a request
+// from being replayed.  Only users that have already registered a key over
+// the envelope protocol can use the gateway.
+const (
+	nickHeader      = "Whisper-Nick"
+	dateHeader      = "Whisper-Date"
+	nonceHeader     = "Whisper-Nonce"
+	signatureHeader = "Whisper-Signature"
+
+	// how far a request's date may be from the server's clock.  Nonces are
+	// remembered for this long in each direction, so a request can't be
+	// replayed.
+	maxClockSkew = 5 * time.Minute
+
+	// the bounds on the length of a nonce.
+	minNonceLength = 16
+	maxNonceLength = 128
+)
+
+var gatewayLimits = newLimiterSet(&options.connLimit)
+
+// gatewayAddr is the remote address of a gateway request.
+type gatewayAddr string
+
+func (g gatewayAddr) Network() string { return "http" }
+func (g gatewayAddr) String() string  { return string(g) }
+
+// gatewayConn stands in for the connection of a gateway request.  Each http
+// request is handled as if it were the only request on a connection of its
+// own, so there's nothing to close and nothing to write to.
+type gatewayConn struct {
+	addr gatewayAddr
+}
+
+func (g gatewayConn) RemoteAddr() net.Addr             { return g.addr }
+func (g gatewayConn) SetWriteDeadline(time.Time) error { return nil }
+func (g gatewayConn) Close() error                     { return nil }
+
+// seenNonces remembers recently used nonces, by nick, so that a captured
+// request can't be sent again.  Expired nonces are swept out whenever the
+// map has doubled in size since the last sweep, rather than on every
+// request.
+var seenNonces = struct {
+	sync.Mutex
+	expires   map[string]time.Time
+	nextSweep int
+}{expires: make(map[string]time.Time, 64), nextSweep: minNonceSweep}
+
+// the fewest remembered nonces that trigger a sweep.
+const minNonceSweep = 1024
+
+// replayed reports whether a nick has used a nonce before, and remembers it
+// if it hasn't.
+func replayed(nick, nonce string) bool {
+	seenNonces.Lock()
+	defer seenNonces.Unlock()
+
+	now := time.Now()
+	if len(seenNonces.expires) >= seenNonces.nextSweep {
+		for k, t := range seenNonces.expires {
+			if now.After(t) {
+				delete(seenNonces.expires, k)
+			}
+		}
+		seenNonces.nextSweep = 2 * len(seenNonces.expires)
+		if seenNonces.nextSweep < minNonceSweep {
+			seenNonces.nextSweep = minNonceSweep
+		}
+	}
+	key := nick + "\x00" + nonce
+	if t, ok := seenNonces.expires[key]; ok && !now.After(t) {
+		return true
+	}
+	seenNonces.expires[key] = now.Add(2 * maxClockSkew)
+	return false
+}
+
+// signingString is the string whose hash is signed for a gateway request.
+func signingString(method, uri, date, nonce, nick string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{method, uri, date, nonce, nick, hex.EncodeToString(sum[:])}, "\n")
+}
+
+// signRequest adds the signature headers to a gateway request.  body must be
+// the request's body.
+func signRequest(r *http.Request, nick string, key *rsa.PrivateKey, body []byte) error {
+	date := time.Now().UTC().Format(time.RFC3339)
+	raw, err := randslice(16)
+	if err != nil {
+		return fmt.Errorf("unable to make nonce: %v", err)
+	}
+	nonce := hex.EncodeToString(raw)
+	hash := sha256.Sum256([]byte(signingString(r.Method, r.URL.RequestURI(), date, nonce, nick, body)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return fmt.Errorf("unable to sign request: %v", err)
+	}
+	r.Header.Set(nickHeader, nick)
+	r.Header.Set(dateHeader, date)
+	r.Header.Set(nonceHeader, nonce)
+	r.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+// authenticate checks a gateway request's signature and returns a connection
+// authenticated as the signer.
+func authenticate(r *http.Request, body []byte) (*serverConnection, error) {
+	s := &serverConnection{conn: gatewayConn{addr: gatewayAddr(r.RemoteAddr)}}
+	s.limit = gatewayLimits.get(s.host())
+
+	if wait := authFailLimits.get(s.host()).wait(); wait > 0 {
+		return nil, throttled(wait, "too many failed requests from this host")
+	}
+	nick, date, sig := r.Header.Get(nickHeader), r.Header.Get(dateHeader), r.Header.Get(signatureHeader)
+	nonce := r.Header.Get(nonceHeader)
+	if nick == "" || date == "" || nonce == "" || sig == "" {
+		return nil, errorf(codeUnauthenticated, "request must be signed with the %s, %s, %s and %s headers", nickHeader, dateHeader, nonceHeader, signatureHeader)
+	}
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return nil, errorf(codeUnauthenticated, "%s must be %d to %d characters", nonceHeader, minNonceLength, maxNonceLength)
+	}
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return nil, errorf(codeUnauthenticated, "bad %s header: %v", dateHeader, err)
+	}
+	if skew := time.Since(t); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errorf(codeUnauthenticated, "request date is %v away from the server's clock", skew)
+	}
+	rawsig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, errorf(codeUnauthenticated, "bad %s header: %v", signatureHeader, err)
+	}
+
+	// an unknown nick and a bad signature get the same error, so that the
+	// gateway can't be used to find out who has an account.
+	key, err := getUserKey(nick)
+	if err != nil {
+		s.authFailed()
+		return nil, errorf(codeUnauthenticated, "bad signature")
+	}
+	hash := sha256.Sum256([]byte(signingString(r.Method, r.URL.RequestURI(), date, nonce, nick, body)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], rawsig); err != nil {
+		s.authFailed()
+		return nil, errorf(codeUnauthenticated, "bad signature")
+	}
+	if replayed(nick, nonce) {
+		return nil, errorf(codeUnauthenticated, "request has already been used")
+	}
+
+	// the signature covers the nick as it was sent; from here on it's the
+	// canonical nick that matters.
+	if nick, err = canonicalNick(nick); err != nil {
+		return nil, err
+	}
+	db, err := getUserDB(nick, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user database: %v", err)
+	}
+	s.nick, s.key, s.db = nick, key, db
+	return s, nil
+}
+
+// gatewayRoute translates an http method and path into the envelope the
+// equivalent protocol request would have carried.
+func gatewayRoute(r *http.Request, body []byte) (*Envelope, error) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	n := 10
+	if v := r.URL.Query().Get("n"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad n: %v", err)
+		}
+		n = i
+	}
+	id := func() (int, error) {
+		i, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, fmt.Errorf("bad id: %v", err)
+		}
+		return i, nil
+	}
+
+	var req request
+	switch {
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "messages":
+		return &Envelope{Kind: Message{}.Kind(), Body: body}, nil
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "messages":
+		req = ListMessages{N: n}
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "messages":
+		i, err := id()
+		if err != nil {
+			return nil, err
+		}
+		req = GetMessage{Id: i}
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "notes":
+		return &Envelope{Kind: EncryptedNote{}.Kind(), Body: body}, nil
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "notes":
+		req = ListNotes{N: n}
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "notes":
+		i, err := id()
+		if err != nil {
+			return nil, err
+		}
+		req = GetNoteRequest{Id: i}
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "keys":
+		req = KeyRequest(parts[1])
+	default:
+		return nil, nil
+	}
+	return wrapRequest(0, req)
+}
+
+// gatewayStatus picks the http status for an error.
+func gatewayStatus(e ErrorDoc) int {
+	switch e.Code {
+	case codeUnauthenticated:
+		return http.StatusUnauthorized
+	case codeForbidden, codeRejected:
+		return http.StatusForbidden
+	case codeRateLimited:
+		return http.StatusTooManyRequests
+	case codeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case codeQuotaExceeded:
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func writeGatewayResponse(w http.ResponseWriter, status int, r interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if e, ok := r.(ErrorDoc); ok && e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(e.RetryAfter+0.999)))
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		error_log.Printf("unable to write gateway response: %v", err)
+	}
+}
+
+func handleGateway(w http.ResponseWriter, r *http.Request) {
+	fail := func(err error) {
+		e := errorDoc(err)
+		error_log.Printf("gateway error from %s: %v", r.RemoteAddr, e)
+		writeGatewayResponse(w, gatewayStatus(e), e)
+	}
+
+	// a max-envelope of 0 means no limit.
+	reader := r.Body
+	if max := currentSettings().maxEnvelope; max > 0 {
+		reader = http.MaxBytesReader(w, r.Body, int64(max))
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		fail(errorf(codeTooLarge, "unable to read request body: %v", err))
+		return
+	}
+	env, err := gatewayRoute(r, body)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if env == nil {
+		writeGatewayResponse(w, http.StatusNotFound, errorf("", "no such endpoint: %s %s", r.Method, r.URL.Path))
+		return
+	}
+	res, err := gatewayRequest(r, body, env)
+	if err != nil {
+		fail(err)
+		return
+	}
+	writeGatewayResponse(w, http.StatusOK, res)
+}
+
+// gatewayRequest authenticates and handles a gateway request.
+func gatewayRequest(r *http.Request, body []byte, env *Envelope) (request, error) {
+	s, err := authenticate(r, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.handleRequest(*env)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res = Bool(true)
+	}
+	return res, nil
+}
+
+// serveGateway runs the http gateway on options.httpPort.
+func serveGateway() {
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", options.httpPort), Handler: http.HandlerFunc(handleGateway)}
+	addHTTPServer(srv)
+	info_log.Printf("gateway listening: %s:%d", options.host, options.httpPort)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		exit(1, "couldn't serve http gateway: %v", err)
+	}
+}
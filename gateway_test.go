@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGatewaySignatures(t *testing.T) {
+	info_log, error_log = log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "whisper-gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	db, err := getUserDB("gateway-test", true)
+	if err != nil {
+		t.Fatalf("unable to create user db: %v", err)
+	}
+	defer func() {
+		dbopenlock.Lock()
+		delete(openDBs, "gateway-test")
+		dbopenlock.Unlock()
+		db.Close()
+	}()
+	keybytes, _ := json.Marshal(key.PublicKey)
+	if err := db.Put([]byte("public_key"), keybytes); err != nil {
+		t.Fatalf("unable to save key: %v", err)
+	}
+
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		handleGateway(w, r)
+		return w.Code
+	}
+	signed := func(method, path string, body []byte) *http.Request {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if err := signRequest(r, "gateway-test", key, body); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := signed("GET", "/notes?n=5", nil)
+	if code := serve(r); code != http.StatusOK {
+		t.Errorf("expected signed request to succeed, saw %d", code)
+	}
+	// the same request, headers and all, a second time
+	replay := httptest.NewRequest("GET", "/notes?n=5", nil)
+	replay.Header = r.Header
+	if code := serve(replay); code != http.StatusUnauthorized {
+		t.Errorf("expected replayed request to be refused, saw %d", code)
+	}
+
+	// identical requests in the same second are told apart by their nonces.
+	for i := 0; i < 3; i++ {
+		if code := serve(signed("GET", "/notes?n=5", nil)); code != http.StatusOK {
+			t.Errorf("expected repeated request %d to succeed, saw %d", i, code)
+		}
+	}
+
+	if code := serve(httptest.NewRequest("GET", "/notes", nil)); code != http.StatusUnauthorized {
+		t.Errorf("expected unsigned request to be refused, saw %d", code)
+	}
+	if code := serve(signed("GET", "/nowhere", nil)); code != http.StatusNotFound {
+		t.Errorf("expected unknown endpoint to be not found, saw %d", code)
+	}
+
+	note := []byte(`{"Key": "a2V5", "Title": "dGl0bGU=", "Body": "Ym9keQ=="}`)
+	r = signed("POST", "/notes", note)
+	r.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"Key": "a2V5", "Title": "ZXZpbA==", "Body": "ZXZpbA=="}`)))
+	if code := serve(r); code != http.StatusUnauthorized {
+		t.Errorf("expected tampered body to be refused, saw %d", code)
+	}
+}
+
+func TestNonceSweep(t *testing.T) {
+	// start from an empty cache, and put back the one other tests use after.
+	seenNonces.Lock()
+	expires, nextSweep := seenNonces.expires, seenNonces.nextSweep
+	seenNonces.expires, seenNonces.nextSweep = make(map[string]time.Time), minNonceSweep
+	defer func() {
+		seenNonces.Lock()
+		seenNonces.expires, seenNonces.nextSweep = expires, nextSweep
+		seenNonces.Unlock()
+	}()
+	old := time.Now().Add(-time.Minute)
+	for i := 0; i < minNonceSweep; i++ {
+		seenNonces.expires[fmt.Sprintf("sweep-test\x00%d", i)] = old
+	}
+	seenNonces.Unlock()
+
+	if replayed("sweep-test", "fresh") {
+		t.Errorf("a new nonce was taken for a replay")
+	}
+	if !replayed("sweep-test", "fresh") {
+		t.Errorf("a reused nonce wasn't noticed")
+	}
+	if replayed("someone-else", "fresh") {
+		t.Errorf("nonces should only clash for the same nick")
+	}
+	seenNonces.Lock()
+	n := len(seenNonces.expires)
+	seenNonces.Unlock()
+	if n >= minNonceSweep {
+		t.Errorf("expected expired nonces to be swept, saw %d left", n)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+)
+
+// Ping is a heartbeat.  Either side sends one when a connection has been
+// quiet for the heartbeat interval, and the other side answers with a Pong.
+// A ping from the client is an ordinary request; a ping from the server is
+// pushed, and the client's pong is pushed back.
+type Ping struct{}
+
+func (p Ping) Kind() string {
+	return "ping"
+}
+
+func init() { registerRequestType(func() request { return new(Ping) }) }
+
+type Pong struct{}
+
+func (p Pong) Kind() string {
+	return "pong"
+}
+
+func init() { registerRequestType(func() request { return new(Pong) }) }
+
+// heartbeatTicker ticks often enough to notice both a quiet connection and a
+// dead one.
+func heartbeatTicker() *time.Ticker {
+	interval := options.heartbeat
+	if options.idleTimeout > 0 && (interval <= 0 || options.idleTimeout < interval) {
+		interval = options.idleTimeout
+	}
+	if interval <= 0 {
+		// heartbeats and reaping are both disabled; tick rarely so that
+		// callers can still select on the channel.
+		interval = time.Hour
+	}
+	return time.NewTicker(interval / 2)
+}
+
+// heartbeat decides what to do with a connection that has been idle for the
+// given duration: whether it's time to send a ping, and whether the
+// connection should be considered dead.
+func heartbeat(idle time.Duration) (ping, dead bool) {
+	if options.idleTimeout > 0 && idle >= options.idleTimeout {
+		return false, true
+	}
+	return options.heartbeat > 0 && idle >= options.heartbeat, false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestReapedConnectionsDontLeak(t *testing.T) {
+	info_log, error_log = log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0)
+	defer func(heartbeat, idle time.Duration) {
+		options.heartbeat, options.idleTimeout = heartbeat, idle
+	}(options.heartbeat, options.idleTimeout)
+	options.heartbeat, options.idleTimeout = 0, 20*time.Millisecond
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		server, client := net.Pipe()
+		defer client.Close()
+		s := serverConnection{
+			conn:  server,
+			codec: newFrameCodec(bufio.NewReader(server), server),
+			limit: newBucket(&options.connLimit),
+		}
+		// the client never says anything, so the connection is reaped.
+		s.run()
+	}
+
+	// give the stream goroutines a moment to see their connections close.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("expected %d goroutines after reaping, saw %d", before, n)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// protocolVersion is the version of the protocol spoken by this build.
+// Version 1 is the original protocol, which had no hello exchange at all.
+// minProtocolVersion is the oldest version we're still willing to talk to.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 2
+)
+
+// cipher suites used for end-to-end encryption.  The only one so far is the
+// original scheme: a random aes key, encrypted with rsa pkcs1 v1.5, used to
+// encrypt the payload with aes-cbc.
+const cipherRSAAESCBC = "rsa-pkcs1v15+aes-128-cbc"
+
+var supportedCiphers = []string{cipherRSAAESCBC}
+
+// Hello is the first request on a connection.  Each side advertises the
+// range of protocol versions it speaks, every request kind it understands,
+// and the cipher suites it supports.  The server responds with a Hello of its
+// own, whose Ciphers are those supported by both sides.
+type Hello struct {
+	Version    int
+	MinVersion int
+	Kinds      []string
+	Ciphers    []string
+}
+
+func (h Hello) Kind() string {
+	return "hello"
+}
+
+func init() { registerRequestType(func() request { return new(Hello) }) }
+
+func newHello() *Hello {
+	kinds := make([]string, 0, len(requestTypes))
+	for kind := range requestTypes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return &Hello{
+		Version:    protocolVersion,
+		MinVersion: minProtocolVersion,
+		Kinds:      kinds,
+		Ciphers:    supportedCiphers,
+	}
+}
+
+// peerInfo is what we've learned about the other side of a connection from
+// its Hello.
+type peerInfo struct {
+	version int
+	kinds   map[string]bool
+	ciphers []string
+}
+
+// negotiate checks a peer's Hello against our own capabilities.
+func negotiate(h *Hello) (*peerInfo, error) {
+	if h.Version < minProtocolVersion {
+		return nil, errorf(codeVersionMismatch, "peer speaks protocol version %d, but version %d or newer is required", h.Version, minProtocolVersion)
+	}
+	if h.MinVersion > protocolVersion {
+		return nil, errorf(codeVersionMismatch, "peer requires protocol version %d or newer, but only version %d is supported here", h.MinVersion, protocolVersion)
+	}
+
+	var ciphers []string
+	for _, theirs := range h.Ciphers {
+		for _, ours := range supportedCiphers {
+			if theirs == ours {
+				ciphers = append(ciphers, theirs)
+			}
+		}
+	}
+	if len(ciphers) == 0 {
+		return nil, errorf(codeVersionMismatch, "no cipher suite in common: peer supports %v, we support %v", h.Ciphers, supportedCiphers)
+	}
+
+	version := h.Version
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	kinds := make(map[string]bool, len(h.Kinds))
+	for _, kind := range h.Kinds {
+		kinds[kind] = true
+	}
+	return &peerInfo{version: version, kinds: kinds, ciphers: ciphers}, nil
+}
+
+// supports reports whether the peer understands a given request kind.
+func (p *peerInfo) supports(kind string) bool {
+	return p != nil && p.kinds[kind]
+}
+
+// unsupported creates the error for a request kind that the peer doesn't
+// understand.
+func (p *peerInfo) unsupported(kind string) error {
+	return errorf(codeUnsupported, "%s is not supported by the peer (protocol version %d)", kind, p.version)
+}
+
+// checkSupported is used before sending a request, so that a peer that
+// doesn't understand it is never sent it.
+func (p *peerInfo) checkSupported(kind string) error {
+	if p == nil || p.supports(kind) {
+		return nil
+	}
+	return p.unsupported(kind)
+}
+
+func (p *peerInfo) String() string {
+	return fmt.Sprintf("protocol version %d, ciphers %v", p.version, p.ciphers)
+}
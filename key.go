@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 func generate() {
@@ -46,7 +49,7 @@ func encrypt() {
 }
 
 func decrypt() {
-	key, err := privateKey()
+	key, err := keyOps()
 	if err != nil {
 		exit(1, "couldn't setup key: %v", err)
 	}
@@ -63,7 +66,7 @@ func decrypt() {
 		exit(1, "error reading b64 buffer %v", err)
 	}
 
-	msg, err := rsa.DecryptPKCS1v15(rand.Reader, key, ctxt)
+	msg, err := key.Decrypt(rand.Reader, ctxt, nil)
 	if err != nil {
 		exit(1, "error decrypting message: %v", err)
 	}
@@ -72,11 +75,11 @@ func decrypt() {
 
 func publicKey() (*rsa.PublicKey, error) {
 	if options.publicKey == "" {
-		priv, err := privateKey()
+		key, err := keyOps()
 		if err != nil {
 			return nil, err
 		}
-		return &priv.PublicKey, nil
+		return key.Public().(*rsa.PublicKey), nil
 	}
 	f, err := os.Open(options.publicKey)
 	if err != nil {
@@ -106,12 +109,23 @@ func privateKey() (*rsa.PrivateKey, error) {
 	return &key, nil
 }
 
+// keyFingerprint identifies a public key by the sha256 of its PKCS #1
+// encoding, formatted as colon-separated hex pairs.
+func keyFingerprint(key *rsa.PublicKey) string {
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(key))
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
+
 func getPublic() {
-	priv, err := privateKey()
+	key, err := keyOps()
 	if err != nil {
-		exit(1, "unable to read private key file: %v", err)
+		exit(1, "unable to read private key: %v", err)
 	}
-	if err := json.NewEncoder(os.Stdout).Encode(priv.PublicKey); err != nil {
+	if err := json.NewEncoder(os.Stdout).Encode(key.Public()); err != nil {
 		exit(1, "unable to marshal key: %v", err)
 	}
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// memStore is a store kept in memory, for tests and for servers that don't
+// need to remember anything.  Its contents last until the process exits;
+// closing it doesn't discard them.
+type memStore struct {
+	sync.RWMutex
+	data map[string][]byte
+}
+
+// memStores holds every memStore by name, so that reopening one finds the
+// same data.
+var memStores = struct {
+	sync.Mutex
+	stores map[string]*memStore
+}{stores: make(map[string]*memStore, 32)}
+
+func openMemStore(name string, create bool) (store, error) {
+	memStores.Lock()
+	defer memStores.Unlock()
+
+	m, ok := memStores.stores[name]
+	if !ok {
+		if !create {
+			return nil, fmt.Errorf("no database named %s", name)
+		}
+		m = &memStore{data: make(map[string][]byte, 64)}
+		memStores.stores[name] = m
+	}
+	return m, nil
+}
+
+func listMemStores() ([]string, error) {
+	memStores.Lock()
+	defer memStores.Unlock()
+
+	names := make([]string, 0, len(memStores.stores))
+	for name := range memStores.stores {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+func (m *memStore) Get(key []byte) ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	val, ok := m.data[string(key)]
+	if !ok {
+		return nil, errNotFound
+	}
+	return copyBytes(val), nil
+}
+
+func (m *memStore) Put(key, value []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.data[string(key)] = copyBytes(value)
+	return nil
+}
+
+func (m *memStore) Delete(key []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.data, string(key))
+	return nil
+}
+
+func (m *memStore) Write(b *batch) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, op := range b.ops {
+		if op.delete {
+			delete(m.data, string(op.key))
+		} else {
+			m.data[string(op.key)] = copyBytes(op.value)
+		}
+	}
+	return nil
+}
+
+func (m *memStore) Close() error {
+	return nil
+}
+
+// NewIterator takes a snapshot of the matching keys, so later writes don't
+// affect an iterator that's already been created.
+func (m *memStore) NewIterator(prefix []byte) iterator {
+	m.RLock()
+	defer m.RUnlock()
+
+	it := &memIterator{pos: -1}
+	for k := range m.data {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			it.keys = append(it.keys, k)
+		}
+	}
+	sort.Strings(it.keys)
+	it.values = make([][]byte, len(it.keys))
+	for i, k := range it.keys {
+		it.values[i] = copyBytes(m.data[k])
+	}
+	return it
+}
+
+type memIterator struct {
+	keys   []string
+	values [][]byte
+	pos    int
+	moved  bool
+	err    error
+}
+
+func (it *memIterator) First() bool {
+	it.moved = true
+	it.pos = 0
+	return it.Valid()
+}
+
+func (it *memIterator) Last() bool {
+	it.moved = true
+	it.pos = len(it.keys) - 1
+	return it.Valid()
+}
+
+func (it *memIterator) Next() bool {
+	if !it.moved {
+		return it.First()
+	}
+	if it.pos < len(it.keys) {
+		it.pos++
+	}
+	return it.Valid()
+}
+
+func (it *memIterator) Prev() bool {
+	if !it.moved {
+		return it.Last()
+	}
+	if it.pos >= 0 {
+		it.pos--
+	}
+	return it.Valid()
+}
+
+func (it *memIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.keys)
+}
+
+func (it *memIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return []byte(it.keys[it.pos])
+}
+
+func (it *memIterator) Value() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.values[it.pos]
+}
+
+func (it *memIterator) Error() error {
+	return it.err
+}
+
+func (it *memIterator) Release() {
+	it.keys, it.values = nil, nil
+}
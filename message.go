@@ -1,6 +1,8 @@
 package main
 
-import ()
+import (
+	"time"
+)
 
 type Message struct {
 	Key  []byte
@@ -15,20 +17,39 @@ func (m Message) Kind() string {
 
 func init() { registerRequestType(func() request { return new(Message) }) }
 
+// ListMessages asks for the N most recently stored messages, last stored
+// first.  If Since is set, only messages received since then are listed.  Archived messages
+// are left out, unless Archived is set, in which case only they are listed.
+// Unread and Starred narrow the listing to messages that are unread, or
+// starred.
 type ListMessages struct {
-	N int
+	N        int
+	Since    time.Time
+	Unread   bool `json:",omitempty"`
+	Starred  bool `json:",omitempty"`
+	Archived bool `json:",omitempty"`
 }
 
+// maxListMessages is the most messages listed in one response.
+const maxListMessages = 100
+
 func (l ListMessages) Kind() string {
 	return "list-messages"
 }
 
 func init() { registerRequestType(func() request { return new(ListMessages) }) }
 
+// ListMessagesResponseItem describes a message.  From is as the sender wrote
+// it, encrypted; Sender is the nick they authenticated as, and Received is
+// when the server got the message.  Messages stored by older servers have
+// neither.
 type ListMessagesResponseItem struct {
-	Id   int
-	Key  []byte
-	From []byte
+	Id       int
+	Key      []byte
+	From     []byte
+	Received time.Time
+	Sender   string `json:",omitempty"`
+	MessageFlags
 }
 
 type ListMessagesResponse []ListMessagesResponseItem
@@ -48,3 +69,52 @@ func (g GetMessage) Kind() string {
 }
 
 func init() { registerRequestType(func() request { return new(GetMessage) }) }
+
+// MessageFlags are kept on every message, each independent of the others.
+// New messages have none set; getting a message marks it read, and any flag
+// can be turned on or off with SetMessageFlag.
+type MessageFlags struct {
+	Read     bool `json:",omitempty"`
+	Archived bool `json:",omitempty"`
+	Starred  bool `json:",omitempty"`
+}
+
+// the names of the message flags, as given to SetMessageFlag.
+const (
+	flagRead     = "read"
+	flagArchived = "archived"
+	flagStarred  = "starred"
+)
+
+// SetMessageFlag turns one of a message's flags on or off.
+type SetMessageFlag struct {
+	Id   int
+	Flag string
+	On   bool
+}
+
+func (s SetMessageFlag) Kind() string {
+	return "set-message-flag"
+}
+
+func init() { registerRequestType(func() request { return new(SetMessageFlag) }) }
+
+// CountMessages asks how many messages there are with each flag.
+type CountMessages struct{}
+
+func (c CountMessages) Kind() string {
+	return "count-messages"
+}
+
+func init() { registerRequestType(func() request { return new(CountMessages) }) }
+
+// MessageCounts is the number of messages with each flag.  Like the listing,
+// the counts leave archived messages out: "total", "unread" and "starred"
+// count the messages that aren't archived, and "archived" the rest.
+type MessageCounts map[string]int
+
+func (m MessageCounts) Kind() string {
+	return "message-counts"
+}
+
+func init() { registerRequestType(func() request { return new(MessageCounts) }) }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestListMessagesSince(t *testing.T) {
+	memoryUsers(t, "since-test")
+
+	db, err := getUserDB("since-test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	// the last message is older than the rest, as if merged in from an
+	// archive.
+	for _, age := range []time.Duration{72 * time.Hour, 36 * time.Hour, time.Hour, 96 * time.Hour} {
+		data, _ := json.Marshal(Message{To: "since-test"})
+		val, _ := json.Marshal(record{Format: messageFormat, Received: now.Add(-age), Sender: "bob", Data: data})
+		if _, err := db.appendItem("messages/", val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &serverConnection{db: db}
+
+	list := func(req ListMessages) ListMessagesResponse {
+		body, _ := json.Marshal(req)
+		res, err := s.handleListMessagesRequest(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.(ListMessagesResponse)
+	}
+	if all := list(ListMessages{N: 10}); len(all) != 4 || all[0].Id != 3 || all[0].Sender != "bob" {
+		t.Errorf("expected 4 messages from bob, last stored first, saw %+v", all)
+	}
+	recent := list(ListMessages{N: 10, Since: now.Add(-48 * time.Hour)})
+	if len(recent) != 2 || recent[1].Id != 1 {
+		t.Errorf("expected the 2 messages from the last 2 days, saw %+v", recent)
+	}
+	if one := list(ListMessages{N: 1}); len(one) != 1 {
+		t.Errorf("asked for 1 message, saw %d", len(one))
+	}
+}
+
+func TestMessageFlags(t *testing.T) {
+	memoryUsers(t, "flag-test")
+
+	db, err := getUserDB("flag-test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		val, _ := encodeRecord(messageFormat, "bob", Message{To: "flag-test"})
+		if _, err := db.appendItem("messages/", val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &serverConnection{db: db}
+	call := func(fn func(json.RawMessage) (request, error), req request) request {
+		body, _ := json.Marshal(req)
+		res, err := fn(body)
+		if err != nil {
+			t.Fatalf("%s: %v", req.Kind(), err)
+		}
+		return res
+	}
+	counts := func() MessageCounts {
+		return call(s.handleCountMessages, CountMessages{}).(MessageCounts)
+	}
+	list := func(req ListMessages) ListMessagesResponse {
+		return call(s.handleListMessagesRequest, req).(ListMessagesResponse)
+	}
+	flag := func(id int, flag string, on bool) {
+		call(s.handleSetMessageFlag, SetMessageFlag{Id: id, Flag: flag, On: on})
+	}
+
+	if n := counts()["unread"]; n != 3 {
+		t.Errorf("expected 3 unread messages, saw %d", n)
+	}
+
+	// starring a message leaves it unread.
+	flag(2, flagStarred, true)
+	if c := counts(); c["unread"] != 3 || c["starred"] != 1 {
+		t.Errorf("expected 3 unread messages, 1 of them starred, saw %v", c)
+	}
+	if unread := list(ListMessages{N: 10, Unread: true}); len(unread) != 3 {
+		t.Errorf("starring a message took it out of the unread listing: %+v", unread)
+	}
+
+	// getting a starred message marks it read, and leaves its star.
+	call(s.handleGetMessageRequest, GetMessage{Id: 2})
+	starred := list(ListMessages{N: 10, Starred: true})
+	if len(starred) != 1 || !starred[0].Read || !starred[0].Starred {
+		t.Errorf("expected message 2 to be read and starred, saw %+v", starred)
+	}
+
+	// archiving a starred message leaves its star.
+	flag(2, flagArchived, true)
+	archived := list(ListMessages{N: 10, Archived: true})
+	if len(archived) != 1 || archived[0].Id != 2 || !archived[0].Starred {
+		t.Errorf("expected message 2 to be archived and still starred, saw %+v", archived)
+	}
+	if all := list(ListMessages{N: 10}); len(all) != 2 || all[0].Id != 1 {
+		t.Errorf("expected archived messages to be left out, saw %+v", all)
+	}
+	if c := counts(); c["total"] != 2 || c["unread"] != 2 || c["starred"] != 0 || c["archived"] != 1 {
+		t.Errorf("expected 2 unread messages and 1 archived, saw %v", c)
+	}
+
+	flag(2, flagArchived, false)
+	flag(2, flagRead, false)
+	if c := counts(); c["unread"] != 3 || c["starred"] != 1 || c["archived"] != 0 {
+		t.Errorf("expected message 2 to be back, unread and starred, saw %v", c)
+	}
+
+	body, _ := json.Marshal(SetMessageFlag{Id: 0, Flag: "shredded", On: true})
+	if _, err := s.handleSetMessageFlag(body); err == nil {
+		t.Errorf("expected an unknown flag to be refused")
+	}
+	body, _ = json.Marshal(SetMessageFlag{Id: 9, Flag: flagRead, On: true})
+	if _, err := s.handleSetMessageFlag(body); err == nil {
+		t.Errorf("expected a missing message to be refused")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// A message's flags are kept in its record, so they go wherever the message
+// does, archives included.
+
+func validMessageFlag(flag string) bool {
+	switch flag {
+	case flagRead, flagArchived, flagStarred:
+		return true
+	}
+	return false
+}
+
+// set turns a flag on or off, reporting whether that changed anything.
+func (f *MessageFlags) set(flag string, on bool) (bool, error) {
+	var p *bool
+	switch flag {
+	case flagRead:
+		p = &f.Read
+	case flagArchived:
+		p = &f.Archived
+	case flagStarred:
+		p = &f.Starred
+	default:
+		return false, fmt.Errorf("unknown message flag %q", flag)
+	}
+	if *p == on {
+		return false, nil
+	}
+	*p = on
+	return true, nil
+}
+
+// setMessageFlag turns one of a message's flags on or off.  It reports
+// whether the message was changed.
+func (db *userdb) setMessageFlag(id int, flag string, on bool) (bool, error) {
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+
+	key := "messages/" + encodeInt(id)
+	val, err := db.Get([]byte(key))
+	if err != nil {
+		return false, err
+	}
+	var r record
+	if err := json.Unmarshal(val, &r); err != nil {
+		return false, fmt.Errorf("unable to parse message: %v", err)
+	}
+	if r.Format != messageFormat {
+		return false, fmt.Errorf("record has format %q, expected %q", r.Format, messageFormat)
+	}
+	changed, err := r.set(flag, on)
+	if err != nil || !changed {
+		return false, err
+	}
+	out, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	if err := db.Put([]byte(key), out); err != nil {
+		return false, err
+	}
+	db.resize(int64(len(out) - len(val)))
+	return true, nil
+}
+
+// countMessages counts the messages with each flag; see MessageCounts.
+func (db *userdb) countMessages() (MessageCounts, error) {
+	it := db.NewIterator([]byte("messages/"))
+	defer it.Release()
+
+	counts := MessageCounts{"total": 0, "unread": 0, "starred": 0, "archived": 0}
+	for it.Next() {
+		var r record
+		if err := json.Unmarshal(it.Value(), &r); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", it.Key(), err)
+		}
+		if r.Archived {
+			counts["archived"]++
+			continue
+		}
+		counts["total"]++
+		if !r.Read {
+			counts["unread"]++
+		}
+		if r.Starred {
+			counts["starred"]++
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// markLegacyRead marks messages stored before there was unread tracking as
+// read, rather than have them all turn up unread.
+func markLegacyRead(key string, val []byte) ([]byte, error) {
+	var r record
+	if err := json.Unmarshal(val, &r); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", key, err)
+	}
+	if r.Read {
+		return nil, nil
+	}
+	r.Read = true
+	return json.Marshal(r)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A nick is 1 to maxNickLength letters, digits, combining marks, underscores
+// and hyphens, starting with a letter or digit.  Nicks are compared in their
+// canonical form: NFKC normalized and case folded, so "Alice", "ALICE" and
+// "ａｌｉｃｅ" are all the same user.  The server only ever stores or looks up
+// canonical nicks.
+
+const maxNickLength = 32
+
+var nickFolder = cases.Fold()
+
+// canonicalNick checks a nick against the nick grammar and returns its
+// canonical form.
+func canonicalNick(nick string) (string, error) {
+	if !utf8.ValidString(nick) {
+		return "", errorf(codeInvalidNick, "nick is not valid utf-8")
+	}
+	// folding can undo normalization, so normalize again afterwards.
+	canon := norm.NFKC.String(nickFolder.String(norm.NFKC.String(nick)))
+
+	n := utf8.RuneCountInString(canon)
+	if n == 0 {
+		return "", errorf(codeInvalidNick, "nick is empty")
+	}
+	if n > maxNickLength {
+		return "", errorf(codeInvalidNick, "nick is longer than %d characters", maxNickLength)
+	}
+	for i, r := range canon {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+		case unicode.In(r, unicode.Mn, unicode.Mc) && i > 0:
+		case (r == '_' || r == '-') && i > 0:
+		default:
+			return "", errorf(codeInvalidNick, "nick %q may only contain letters, digits, _ and -, and must start with a letter or digit", nick)
+		}
+	}
+	return canon, nil
+}
+
+// storeName is the name of a nick's store.  It's derived from the nick but
+// never contains it, so that no nick can pick a path on disk.
+func storeName(nick string) string {
+	return storePrefix + hex.EncodeToString([]byte(nick))
+}
+
+// storePrefix starts the name of every per-user store.  It can't be mistaken
+// for a nick, since nicks can't contain dots.
+const storePrefix = "user."
+
+// storeNick is the reverse of storeName.  ok is false for names that weren't
+// made by storeName.
+func storeNick(name string) (nick string, ok bool) {
+	if !strings.HasPrefix(name, storePrefix) {
+		return "", false
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(name, storePrefix))
+	if err != nil {
+		return "", false
+	}
+	nick, err = canonicalNick(string(b))
+	if err != nil || nick != string(b) {
+		return "", false
+	}
+	return nick, true
+}
+
+// checkNicks canonicalizes a list of nicks in place.
+func checkNicks(nicks []string) error {
+	for i, nick := range nicks {
+		canon, err := canonicalNick(nick)
+		if err != nil {
+			return err
+		}
+		nicks[i] = canon
+	}
+	return nil
+}
+
+// legacyNick is the nick of a store named by an older server, which named
+// per-user databases after the nick itself.
+func legacyNick(name string) (string, error) {
+	nick, err := canonicalNick(name)
+	if err != nil {
+		return "", fmt.Errorf("database %s isn't named after a valid nick: %v", name, err)
+	}
+	return nick, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalNick(t *testing.T) {
+	good := map[string]string{
+		"alice":        "alice",
+		"Alice":        "alice",
+		"ALICE":        "alice",
+		"ａｌｉｃｅ":        "alice",
+		"Straße":       "strasse",
+		"bob_2-b":      "bob_2-b",
+		"ÉLODIE":       "élodie",
+		"E\u0301lodie": "élodie",
+	}
+	for in, want := range good {
+		got, err := canonicalNick(in)
+		if err != nil {
+			t.Errorf("expected %q to be accepted, saw %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("expected %q to become %q, saw %q", in, want, got)
+		}
+	}
+
+	bad := []string{
+		"",
+		"../../etc/x",
+		"a/b",
+		".hidden",
+		"-dash",
+		"_under",
+		"user.6162",
+		"with space",
+		"nul\x00",
+		"\xff",
+		strings.Repeat("a", maxNickLength+1),
+	}
+	for _, in := range bad {
+		if _, err := canonicalNick(in); err == nil {
+			t.Errorf("expected %q to be refused", in)
+		}
+	}
+
+	if nick, ok := storeNick(storeName("élodie")); !ok || nick != "élodie" {
+		t.Errorf("store name didn't round trip: %q %v", nick, ok)
+	}
+	if _, ok := storeNick("alice"); ok {
+		t.Errorf("a bare nick shouldn't be taken for a store name")
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	defer func(admins string) { options.admins = admins }(options.admins)
+	options.admins = "Alice, ,../x,BOB"
+
+	for _, nick := range []string{"alice", "bob"} {
+		if !isAdmin(nick) {
+			t.Errorf("expected %s to be an admin", nick)
+		}
+	}
+	for _, nick := range []string{"", "carol", "Alice"} {
+		if isAdmin(nick) {
+			t.Errorf("expected %q not to be an admin", nick)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"github.com/jordanorelli/lexnum"
+	"time"
 )
 
 var numEncoder = lexnum.NewEncoder('=', '-')
@@ -51,20 +52,32 @@ func randslice(n int) ([]byte, error) {
 	return b, nil
 }
 
+// ListNotes asks for the N most recent notes, newest first.  To page back
+// through older notes, set Before to the lowest id seen so far; only notes
+// with smaller ids are listed.  A Before of 0 starts from the newest note.
 type ListNotes struct {
-	N int
+	N      int
+	Before int `json:",omitempty"`
 }
 
+// maxListNotes is the most notes listed in one response.
+const maxListNotes = 100
+
 func (l ListNotes) Kind() string {
 	return "list-notes-request"
 }
 
 func init() { registerRequestType(func() request { return new(ListNotes) }) }
 
+// ListNotesResponseItem describes a note.  Received is when the server got
+// the note, and Sender is who sent it; both are empty for notes stored by
+// older servers.
 type ListNotesResponseItem struct {
-	Id    int
-	Key   []byte
-	Title []byte
+	Id       int
+	Key      []byte
+	Title    []byte
+	Received time.Time
+	Sender   string `json:",omitempty"`
 }
 
 type ListNotesResponse []ListNotesResponseItem
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notes can be exported by the client, which is the only thing that can read
+// them.  They're written either as a directory of markdown files, one per
+// note, or as a single archive sealed with a passphrase, for keeping a copy
+// somewhere that isn't trusted.  Either can be imported again, which encrypts
+// the notes anew and uploads them as new notes.
+
+// noteArchiveVersion is the version of the passphrase archive format.
+const noteArchiveVersion = 1
+
+// an exportedNote is a decrypted note.
+type exportedNote struct {
+	Id       int
+	Title    string
+	Body     string
+	Received time.Time
+	Exported time.Time
+}
+
+// fileName is the name of the markdown file a note is exported to.
+func (n *exportedNote) fileName() string {
+	return fmt.Sprintf("%d.md", n.Id)
+}
+
+// markdown renders a note as markdown with a front-matter header.
+func (n *exportedNote) markdown() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "---")
+	fmt.Fprintf(&buf, "id: %d\n", n.Id)
+	fmt.Fprintf(&buf, "title: %s\n", strconv.Quote(n.Title))
+	if !n.Received.IsZero() {
+		fmt.Fprintf(&buf, "received: %s\n", n.Received.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&buf, "exported: %s\n", n.Exported.Format(time.RFC3339))
+	fmt.Fprintln(&buf, "---")
+	buf.WriteString(n.Body)
+	// the file always ends in a newline; parseNoteFile takes it back off.
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// parseNoteFile reads a markdown note.  The front-matter is optional, so any
+// markdown file can be imported; without a title, the note is named after
+// the file.
+func parseNoteFile(name string, b []byte) (*exportedNote, error) {
+	n := &exportedNote{Title: strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))}
+	text := string(b)
+	if !strings.HasPrefix(text, "---\n") {
+		n.Body = text
+		return n, nil
+	}
+
+	s := bufio.NewScanner(strings.NewReader(strings.TrimPrefix(text, "---\n")))
+	read := len("---\n")
+	for s.Scan() {
+		line := s.Text()
+		read += len(line) + 1
+		if line == "---" {
+			if read > len(text) {
+				read = len(text)
+			}
+			n.Body = strings.TrimSuffix(text[read:], "\n")
+			return n, nil
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: bad front-matter line %q", name, line)
+		}
+		k, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch k {
+		case "id":
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad id %q: %v", name, v, err)
+			}
+			n.Id = id
+		case "title":
+			if t, err := strconv.Unquote(v); err == nil {
+				v = t
+			}
+			n.Title = v
+		case "received", "exported":
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad time %q: %v", name, v, err)
+			}
+			if k == "received" {
+				n.Received = t
+			} else {
+				n.Exported = t
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: front-matter is never closed", name)
+}
+
+// noteArchive is a set of notes sealed with a passphrase.  The key is
+// derived from the passphrase with scrypt, and the notes are sealed with
+// AES-GCM.
+type noteArchive struct {
+	Version int
+	Salt    []byte
+	N, R, P int
+	Nonce   []byte
+	Notes   []byte
+}
+
+func (a *noteArchive) key(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, a.Salt, a.N, a.R, a.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive key from passphrase: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealNotes writes notes to a passphrase protected archive.
+func sealNotes(notes []exportedNote, passphrase []byte) ([]byte, error) {
+	salt, err := randslice(16)
+	if err != nil {
+		return nil, err
+	}
+	a := &noteArchive{Version: noteArchiveVersion, Salt: salt, N: 1 << 15, R: 8, P: 1}
+	aead, err := a.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if a.Nonce, err = randslice(aead.NonceSize()); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(notes)
+	if err != nil {
+		return nil, err
+	}
+	a.Notes = aead.Seal(nil, a.Nonce, raw, nil)
+	return json.MarshalIndent(a, "", "  ")
+}
+
+// isNoteArchive reports whether b looks like a passphrase archive rather
+// than a markdown note.
+func isNoteArchive(b []byte) bool {
+	var a noteArchive
+	return json.Unmarshal(b, &a) == nil && a.Version > 0 && a.Salt != nil
+}
+
+// openNotes reads the notes out of a passphrase protected archive.
+func openNotes(b []byte, passphrase []byte) ([]exportedNote, error) {
+	var a noteArchive
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("unable to parse note archive: %v", err)
+	}
+	if a.Version < 1 || a.Version > noteArchiveVersion {
+		return nil, fmt.Errorf("note archive version %d is not supported", a.Version)
+	}
+	aead, err := a.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("note archive has a bad nonce")
+	}
+	raw, err := aead.Open(nil, a.Nonce, a.Notes, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open note archive: wrong passphrase?")
+	}
+	var notes []exportedNote
+	if err := json.Unmarshal(raw, &notes); err != nil {
+		return nil, fmt.Errorf("unable to parse notes in archive: %v", err)
+	}
+	return notes, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNoteFile(t *testing.T) {
+	n := exportedNote{
+		Id:       12,
+		Title:    `groceries: "the list"`,
+		Body:     "eggs\n---\nmilk\n",
+		Received: time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC),
+		Exported: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	got, err := parseNoteFile(n.fileName(), n.markdown())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != n {
+		t.Errorf("note didn't round trip: expected %+v, saw %+v", n, *got)
+	}
+
+	plain, err := parseNoteFile("dir/todo.md", []byte("# things\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Title != "todo" || plain.Body != "# things\n" {
+		t.Errorf("expected a plain file to be named after itself, saw %+v", *plain)
+	}
+
+	if _, err := parseNoteFile("bad.md", []byte("---\nid: 1\n")); err == nil {
+		t.Errorf("expected unclosed front-matter to be refused")
+	}
+
+	sealed, err := sealNotes([]exportedNote{n}, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isNoteArchive(sealed) || isNoteArchive(n.markdown()) {
+		t.Errorf("note archives aren't told apart from markdown")
+	}
+	if _, err := openNotes(sealed, []byte("hunter3")); err == nil {
+		t.Errorf("expected the wrong passphrase to be refused")
+	}
+	notes, err := openNotes(sealed, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0] != n {
+		t.Errorf("archive didn't round trip: saw %+v", notes)
+	}
+}
+
+func TestListNotesPaging(t *testing.T) {
+	memoryUsers(t, "paging-test")
+
+	db, err := getUserDB("paging-test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, _ := encodeRecord(noteFormat, "paging-test", EncryptedNote{})
+	for i := 0; i < 25; i++ {
+		if _, err := db.appendItem("notes/", val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &serverConnection{db: db}
+
+	seen, before := 0, 0
+	for {
+		body, _ := json.Marshal(ListNotes{N: 10, Before: before})
+		res, err := s.handleListNotesRequest(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := res.(ListNotesResponse)
+		if len(page) == 0 {
+			break
+		}
+		for _, item := range page {
+			if want := 24 - seen; item.Id != want {
+				t.Fatalf("expected note %d, saw %d", want, item.Id)
+			}
+			seen++
+			before = item.Id
+		}
+		if len(page) > 10 {
+			t.Errorf("asked for 10 notes, saw %d", len(page))
+		}
+		if before == 0 {
+			break
+		}
+	}
+	if seen != 25 {
+		t.Errorf("expected to page through 25 notes, saw %d", seen)
+	}
+}
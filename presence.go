@@ -0,0 +1,236 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	statusOnline  = "online"
+	statusAway    = "away"
+	statusOffline = "offline"
+
+	presenceHiddenKey = "presence_hidden"
+)
+
+func validStatus(status string) bool {
+	switch status {
+	case statusOnline, statusAway, statusOffline:
+		return true
+	default:
+		return false
+	}
+}
+
+// Presence is a user's published status.  It's sent as the response to a
+// SetPresence and pushed to subscribers whenever a status changes.
+type Presence struct {
+	Nick   string
+	Status string
+}
+
+func (p Presence) Kind() string {
+	return "presence"
+}
+
+func init() { registerRequestType(func() request { return new(Presence) }) }
+
+// SetPresence publishes the user's status.  Presence is opt-in: users that
+// have never published a status don't appear as online to anyone.
+type SetPresence struct {
+	Status string
+}
+
+func (s SetPresence) Kind() string {
+	return "set-presence"
+}
+
+func init() { registerRequestType(func() request { return new(SetPresence) }) }
+
+// PresencePrivacy hides a user's presence from everyone, regardless of their
+// contact list.
+type PresencePrivacy struct {
+	Hidden bool
+}
+
+func (p PresencePrivacy) Kind() string {
+	return "set-presence-privacy"
+}
+
+func init() { registerRequestType(func() request { return new(PresencePrivacy) }) }
+
+// SubscribePresence asks the server to push status changes for the given
+// nicks.  The response is the current status of each nick the subscriber is
+// allowed to see.
+type SubscribePresence struct {
+	Nicks []string
+}
+
+func (s SubscribePresence) Kind() string {
+	return "subscribe-presence"
+}
+
+func init() { registerRequestType(func() request { return new(SubscribePresence) }) }
+
+type PresenceList []Presence
+
+func (p PresenceList) Kind() string {
+	return "presence-list"
+}
+
+func init() { registerRequestType(func() request { return new(PresenceList) }) }
+
+// sessions tracks every authenticated connection on the server, along with
+// the status each nick has published.
+var sessions = struct {
+	sync.Mutex
+	conns  map[string]map[*serverConnection]bool
+	status map[string]string
+}{
+	conns:  make(map[string]map[*serverConnection]bool, 32),
+	status: make(map[string]string, 32),
+}
+
+func addSession(s *serverConnection) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	conns, ok := sessions.conns[s.nick]
+	if !ok {
+		conns = make(map[*serverConnection]bool, 1)
+		sessions.conns[s.nick] = conns
+	}
+	conns[s] = true
+}
+
+// removeSession forgets a connection.  When a nick's last connection goes
+// away, its published status becomes offline.
+func removeSession(s *serverConnection) {
+	sessions.Lock()
+	conns := sessions.conns[s.nick]
+	delete(conns, s)
+	last := len(conns) == 0
+	if last {
+		delete(sessions.conns, s.nick)
+	}
+	status, published := sessions.status[s.nick]
+	sessions.Unlock()
+
+	if last && published && status != statusOffline {
+		publishPresence(s.nick, statusOffline)
+	}
+}
+
+// allConnections returns every authenticated connection.
+func allConnections() []*serverConnection {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	all := make([]*serverConnection, 0, len(sessions.conns))
+	for _, conns := range sessions.conns {
+		for conn := range conns {
+			all = append(all, conn)
+		}
+	}
+	return all
+}
+
+// currentStatus returns the status a nick has published, or offline if it
+// has published nothing.
+func currentStatus(nick string) string {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if status, ok := sessions.status[nick]; ok {
+		return status
+	}
+	return statusOffline
+}
+
+// publishPresence records a nick's status and pushes it to every connection
+// that is watching the nick and allowed to see it.
+func publishPresence(nick, status string) {
+	sessions.Lock()
+	if status == statusOffline {
+		delete(sessions.status, nick)
+	} else {
+		sessions.status[nick] = status
+	}
+	sessions.Unlock()
+
+	update := Presence{Nick: nick, Status: status}
+	for _, conn := range allConnections() {
+		if !conn.isWatching(nick) || !conn.peer.supports(update.Kind()) {
+			continue
+		}
+		ok, err := canSeePresence(conn.nick, nick)
+		if err != nil {
+			error_log.Printf("unable to check presence visibility: %v", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := conn.sendResponse(pushId, update); err != nil {
+			error_log.Printf("unable to push presence to %s: %v", conn.nick, err)
+		}
+	}
+}
+
+// hidePresence tells everyone watching a nick that it's offline, regardless
+// of whether they're allowed to see it any more.  It's used when a user hides
+// their presence.
+func hidePresence(nick string) {
+	update := Presence{Nick: nick, Status: statusOffline}
+	for _, conn := range allConnections() {
+		if conn.nick == nick || !conn.isWatching(nick) || !conn.peer.supports(update.Kind()) {
+			continue
+		}
+		if err := conn.sendResponse(pushId, update); err != nil {
+			error_log.Printf("unable to push presence to %s: %v", conn.nick, err)
+		}
+	}
+}
+
+// canSeePresence checks whether watcher is allowed to see target's status.
+// The target must have the watcher as a contact, must not have blocked them,
+// and must not have hidden their presence.
+func canSeePresence(watcher, target string) (bool, error) {
+	if watcher == target {
+		return true, nil
+	}
+	db, err := getUserDB(target, false)
+	if err != nil {
+		return false, nil
+	}
+	hidden, err := db.presenceHidden()
+	if err != nil || hidden {
+		return false, err
+	}
+	blocked, err := db.isBlocked(watcher)
+	if err != nil || blocked {
+		return false, err
+	}
+	return db.isContact(watcher)
+}
+
+func (db *userdb) presenceHidden() (bool, error) {
+	return db.hasKey(presenceHiddenKey)
+}
+
+func (s *serverConnection) isWatching(nick string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watching[nick]
+}
+
+func (s *serverConnection) watch(nicks []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.watching == nil {
+		s.watching = make(map[string]bool, len(nicks))
+	}
+	for _, nick := range nicks {
+		s.watching[nick] = true
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// prefixes of the keys that count as stored items for the purposes of the
+// per-user item quota.
+var quotaPrefixes = [][]byte{
+	[]byte("messages/"),
+	[]byte("notes/"),
+	[]byte("blobs/"),
+}
+
+// diskUsage tracks how much a single user database is storing.
+type diskUsage struct {
+	Bytes int64
+	Items int
+}
+
+// checkEnvelope enforces the maximum envelope size on an incoming request
+// body.
+func checkEnvelope(e Envelope) error {
+	max := currentSettings().maxEnvelope
+	if max > 0 && len(e.Body) > max {
+		return errorf(codeTooLarge, "request of %d bytes exceeds maximum envelope size of %d bytes", len(e.Body), max)
+	}
+	return nil
+}
+
+// checkBody enforces the maximum size of a message or note body.
+func checkBody(b []byte) error {
+	max := currentSettings().maxBody
+	if max > 0 && len(b) > max {
+		return errorf(codeTooLarge, "body of %d bytes exceeds maximum body size of %d bytes", len(b), max)
+	}
+	return nil
+}
+
+// loadUsage scans the whole database to compute its usage.  It's called once
+// per database, the first time its usage is needed; after that the counters
+// are maintained as items are written.
+func (db *userdb) loadUsage() error {
+	if db.usage != nil {
+		return nil
+	}
+	it := db.NewIterator(nil)
+	defer it.Release()
+
+	var u diskUsage
+	for it.Next() {
+		u.Bytes += int64(len(it.Key()) + len(it.Value()))
+		if isQuotaItem(it.Key()) {
+			u.Items++
+		}
+	}
+	if err := it.Error(); err != nil {
+		return fmt.Errorf("unable to compute database usage: %v", err)
+	}
+	db.usage = &u
+	return nil
+}
+
+func isQuotaItem(key []byte) bool {
+	for _, prefix := range quotaPrefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getUsage returns a copy of the database's current usage.
+func (db *userdb) getUsage() (diskUsage, error) {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	if err := db.loadUsage(); err != nil {
+		return diskUsage{}, err
+	}
+	return *db.usage, nil
+}
+
+// reserve checks that storing a new item of the given key and value sizes
+// would keep the database under its quota and, if so, counts it against the
+// database's usage.  Callers that then fail to write the item should give the
+// space back with release.
+func (db *userdb) reserve(key string, val []byte) error {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	if err := db.loadUsage(); err != nil {
+		return err
+	}
+	size := int64(len(key) + len(val))
+	cfg := currentSettings()
+	if cfg.quotaBytes > 0 && db.usage.Bytes+size > cfg.quotaBytes {
+		return errorf(codeQuotaExceeded, "storage quota of %d bytes exceeded", cfg.quotaBytes)
+	}
+	if cfg.quotaItems > 0 && db.usage.Items+1 > cfg.quotaItems {
+		return errorf(codeQuotaExceeded, "storage quota of %d items exceeded", cfg.quotaItems)
+	}
+	db.usage.Bytes += size
+	db.usage.Items++
+	return nil
+}
+
+// release undoes a reservation made with reserve.
+func (db *userdb) release(key string, val []byte) {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	if db.usage == nil {
+		return
+	}
+	db.usage.Bytes -= int64(len(key) + len(val))
+	db.usage.Items--
+}
+
+// grow checks that an item that's already stored can grow by delta bytes and
+// stay under the byte quota and, if so, counts the change.  Shrinking always
+// succeeds.  A failed write should be undone with resize(-delta).
+func (db *userdb) grow(delta int64) error {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	if err := db.loadUsage(); err != nil {
+		return err
+	}
+	max := currentSettings().quotaBytes
+	if delta > 0 && max > 0 && db.usage.Bytes+delta > max {
+		return errorf(codeQuotaExceeded, "storage quota of %d bytes exceeded", max)
+	}
+	db.usage.Bytes += delta
+	return nil
+}
+
+// resize counts a change in the size of an item that's already stored.
+func (db *userdb) resize(delta int64) {
+	db.usageLock.Lock()
+	defer db.usageLock.Unlock()
+
+	if db.usage != nil {
+		db.usage.Bytes += delta
+	}
+}
+
+// listUsers finds the nick of every user that has a database on this server.
+func listUsers() ([]string, error) {
+	nicks, err := listStoreUsers()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(nicks)
+	return nicks, nil
+}
+
+func isAdmin(nick string) bool {
+	if nick == "" {
+		return false
+	}
+	for _, admin := range strings.Split(currentSettings().admins, ",") {
+		// nick is already canonical, so -admins Alice has to be too.
+		admin, err := canonicalNick(strings.TrimSpace(admin))
+		if err == nil && admin == nick {
+			return true
+		}
+	}
+	return false
+}
+
+type UsageRequest struct{}
+
+func (u UsageRequest) Kind() string {
+	return "usage-report"
+}
+
+func init() { registerRequestType(func() request { return new(UsageRequest) }) }
+
+type UsageResponseItem struct {
+	Nick  string
+	Bytes int64
+	Items int
+}
+
+type UsageResponse []UsageResponseItem
+
+func (u UsageResponse) Kind() string {
+	return "usage-report-response"
+}
+
+func init() { registerRequestType(func() request { return new(UsageResponse) }) }
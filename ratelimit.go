@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit describes a token bucket: Rate tokens are added per second, up to
+// a maximum of Burst tokens.  It satisfies flag.Value so that limits can be
+// given on the command line as rate:burst, e.g. 20:40.  A zero rate disables
+// the limit.
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (r *rateLimit) String() string {
+	return fmt.Sprintf("%g:%d", r.Rate, r.Burst)
+}
+
+func (r *rateLimit) Set(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return fmt.Errorf("bad rate in rate limit %q: %v", s, err)
+	}
+	burst := int(math.Ceil(rate))
+	if len(parts) == 2 {
+		burst, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("bad burst in rate limit %q: %v", s, err)
+		}
+	}
+	if rate < 0 || burst < 0 {
+		return fmt.Errorf("rate limit %q cannot be negative", s)
+	}
+	r.Rate, r.Burst = rate, burst
+	return nil
+}
+
+// current returns a copy of a limit that may be changed by a config reload.
+func (r *rateLimit) current() rateLimit {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return *r
+}
+
+// bucket is a single token bucket.
+type bucket struct {
+	sync.Mutex
+	limit  *rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit *rateLimit) *bucket {
+	return &bucket{
+		limit:  limit,
+		tokens: float64(limit.current().Burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last refill.  The caller must
+// hold the bucket's lock.
+func (b *bucket) refill(now time.Time, limit rateLimit) {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if max := float64(limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// wait reports how long it will be until the bucket has a token available,
+// without taking one.  It returns zero if a token is available now.
+func (b *bucket) wait() time.Duration {
+	limit := b.limit.current()
+	if limit.Rate == 0 {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now(), limit)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// take removes a token from the bucket.  If the bucket is empty, no token is
+// taken and take returns how long the caller should wait before trying again.
+func (b *bucket) take() time.Duration {
+	limit := b.limit.current()
+	if limit.Rate == 0 {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now(), limit)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// drain removes a token from the bucket whether or not one is available,
+// letting the bucket go into debt.
+func (b *bucket) drain() {
+	limit := b.limit.current()
+	if limit.Rate == 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now(), limit)
+	b.tokens--
+}
+
+// full reports whether the bucket has refilled completely, meaning that it
+// can be discarded without changing anyone's limits.
+func (b *bucket) full() bool {
+	limit := b.limit.current()
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now(), limit)
+	return b.tokens >= float64(limit.Burst)
+}
+
+// limiterSet is a collection of buckets sharing the same limit, keyed by
+// whatever is being limited (a nick, a host, a pair of nicks).
+type limiterSet struct {
+	sync.Mutex
+	limit   *rateLimit
+	buckets map[string]*bucket
+	calls   int
+}
+
+func newLimiterSet(limit *rateLimit) *limiterSet {
+	return &limiterSet{
+		limit:   limit,
+		buckets: make(map[string]*bucket, 32),
+	}
+}
+
+// get returns the bucket for the given key, creating it if necessary.  Every
+// so often, buckets that have refilled completely are swept away so that the
+// set doesn't grow without bound.
+func (l *limiterSet) get(key string) *bucket {
+	l.Lock()
+	defer l.Unlock()
+
+	l.calls++
+	if l.calls%1024 == 0 {
+		for k, b := range l.buckets {
+			if b.full() {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newBucket(l.limit)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+var (
+	nickLimits     = newLimiterSet(&options.nickLimit)
+	pairLimits     = newLimiterSet(&options.pairLimit)
+	authLimits     = newLimiterSet(&options.authLimit)
+	authFailLimits = newLimiterSet(&options.authFailLimit)
+)
+
+// throttled creates the error sent to a client that has exceeded one of its
+// rate limits.
+func throttled(wait time.Duration, template string, args ...interface{}) ErrorDoc {
+	e := errorf(codeRateLimited, template, args...)
+	e.RetryAfter = wait.Seconds()
+	return e
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// connState is the state of the client's connection to the server.
+type connState int
+
+const (
+	stateConnecting connState = iota
+	stateConnected
+	stateReconnecting
+	stateClosed
+)
+
+// pending is a request that has been sent to the server and is waiting for
+// its response.  A pending request is settled exactly once: by its response,
+// by an error, or by its context ending.
+type pending struct {
+	req  request
+	res  chan request
+	ctx  context.Context
+	once sync.Once
+	done chan struct{}
+}
+
+func newPending(ctx context.Context, r request) *pending {
+	return &pending{
+		req:  r,
+		res:  make(chan request, 1),
+		ctx:  ctx,
+		done: make(chan struct{}),
+	}
+}
+
+// complete settles a pending request.  Only the first call has any effect.
+func (p *pending) complete(r request) {
+	p.once.Do(func() {
+		p.res <- r
+		close(p.res)
+		close(p.done)
+	})
+}
+
+// idempotentKinds are the requests that can safely be sent to the server a
+// second time if the connection drops before their response arrives.
+// Anything else is failed instead, since the server may or may not have
+// acted on it.
+var idempotentKinds = map[string]bool{
+	"get-note":             true,
+	"list-notes-request":   true,
+	"get-key":              true,
+	"get-message":          true,
+	"list-messages":        true,
+	"set-message-flag":     true,
+	"count-messages":       true,
+	"list-contacts":        true,
+	"update-contact":       true,
+	"set-inbox-policy":     true,
+	"set-presence":         true,
+	"set-presence-privacy": true,
+	"subscribe-presence":   true,
+	"store-blob":           true,
+	"get-blob":             true,
+	"usage-report":         true,
+	"ping":                 true,
+}
+
+func (c *Client) promptFor(state connState) string {
+	addr := c.addr()
+	switch state {
+	case stateConnected:
+		if c.unread > 0 {
+			return fmt.Sprintf("%s \033[1m(%d unread)\033[0m> ", addr, c.unread)
+		}
+		return fmt.Sprintf("%s> ", addr)
+	case stateReconnecting:
+		return fmt.Sprintf("\033[33m(reconnecting)\033[0m %s> ", addr)
+	default:
+		return fmt.Sprintf("\033[90m(connecting)\033[0m %s> ", addr)
+	}
+}
+
+func (c *Client) setState(state connState) {
+	c.rlock.Lock()
+	c.state = state
+	c.rlock.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prompt = c.promptFor(state)
+	c.renderLine()
+}
+
+// fail delivers an error to a pending request in place of its response.
+func (p *pending) fail(code, template string, args ...interface{}) {
+	e := errorf(code, template, args...)
+	p.complete(&e)
+}
+
+// expire fails a pending request when its context ends before a response
+// arrives, and forgets it so that a late response is discarded.
+func (c *Client) expire(p *pending, cancel context.CancelFunc) {
+	defer cancel()
+	select {
+	case <-p.done:
+		return
+	case <-p.ctx.Done():
+	}
+
+	c.rlock.Lock()
+	for id, q := range c.outstanding {
+		if q == p {
+			delete(c.outstanding, id)
+		}
+	}
+	c.rlock.Unlock()
+
+	if p.ctx.Err() == context.DeadlineExceeded {
+		p.fail(codeTimeout, "%s request timed out", p.req.Kind())
+	} else {
+		p.fail(codeCanceled, "%s request canceled", p.req.Kind())
+	}
+}
+
+// disconnected is called when the connection to the server ends.  In-flight
+// requests are either held for replay or failed, and the client starts
+// trying to reconnect.
+func (c *Client) disconnected(conn transport) {
+	c.rlock.Lock()
+	if c.conn != conn || c.state == stateClosed {
+		c.rlock.Unlock()
+		return
+	}
+	// a connection that drops during the reconnect handshake is handled by
+	// the reconnect loop that's already running.
+	reconnecting := c.state == stateReconnecting
+	c.state = stateReconnecting
+	inflight := c.outstanding
+	c.outstanding = make(map[int]*pending)
+	c.rlock.Unlock()
+
+	ids := make([]int, 0, len(inflight))
+	for id := range inflight {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var replay []*pending
+	for _, id := range ids {
+		p := inflight[id]
+		if !reconnecting && idempotentKinds[p.req.Kind()] {
+			replay = append(replay, p)
+			continue
+		}
+		p.fail(codeDisconnected, "connection to server lost before %s request completed", p.req.Kind())
+	}
+
+	if reconnecting {
+		return
+	}
+	c.err("lost connection to server")
+	c.setState(stateReconnecting)
+	go c.reconnect(replay)
+}
+
+// reconnect dials the server with exponential backoff until a connection is
+// established and the handshake succeeds, then replays any held requests.
+func (c *Client) reconnect(replay []*pending) {
+	backoff := options.reconnectMin
+	for {
+		c.info("reconnecting in %v", backoff)
+		select {
+		case <-c.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > options.reconnectMax {
+			backoff = options.reconnectMax
+		}
+
+		if err := c.dial(); err != nil {
+			c.info("%v", err)
+			continue
+		}
+		if err := c.handshake(); err != nil {
+			c.err("reconnect failed: %v", err)
+			c.conn.Close()
+			continue
+		}
+		break
+	}
+
+	c.setState(stateConnected)
+	c.info("reconnected to server")
+	for _, p := range replay {
+		if p.ctx.Err() != nil {
+			// expire has already failed it
+			continue
+		}
+		if err := c.dispatch(p, false); err != nil {
+			p.fail(codeDisconnected, "unable to replay %s request: %v", p.req.Kind(), err)
+		}
+	}
+	c.restoreSession()
+	c.refreshUnread()
+}
+
+// restoreSession re-establishes the per-connection state that the server
+// forgot when the connection dropped: presence subscriptions and our own
+// published status.
+func (c *Client) restoreSession() {
+	c.plock.Lock()
+	nicks := make([]string, 0, len(c.presence))
+	for nick := range c.presence {
+		nicks = append(nicks, nick)
+	}
+	c.plock.Unlock()
+	c.watchPresence(nicks)
+
+	if c.status != "" && c.status != statusOffline {
+		c.publishPresence([]string{c.status})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	good := map[string]time.Duration{
+		"90s":  90 * time.Second,
+		"2h":   2 * time.Hour,
+		"2d":   48 * time.Hour,
+		"1.5d": 36 * time.Hour,
+		"1w":   7 * 24 * time.Hour,
+	}
+	for in, want := range good {
+		if got, err := parseAge(in); err != nil || got != want {
+			t.Errorf("expected %q to be %v, saw %v %v", in, want, got, err)
+		}
+	}
+	for _, in := range []string{"", "d", "-2d", "two days", "-1h"} {
+		if _, err := parseAge(in); err == nil {
+			t.Errorf("expected %q to be refused", in)
+		}
+	}
+}
+
+func TestAgo(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[time.Duration]string{
+		10 * time.Second: "just now",
+		5 * time.Minute:  "5m ago",
+		3 * time.Hour:    "3h ago",
+		50 * time.Hour:   "2d ago",
+	}
+	for d, want := range cases {
+		if got := ago(now.Add(-d), now); got != want {
+			t.Errorf("expected %v to be %q, saw %q", d, want, got)
+		}
+	}
+	if got := ago(time.Time{}, now); got != "-" {
+		t.Errorf("expected the zero time to be -, saw %q", got)
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 )
 
 var requestTypes = make(map[string]func() request, 32)
 
+// pushId is the envelope id used for messages that the server sends on its
+// own initiative rather than in response to a request.
+const pushId = -1
+
 func registerRequestType(fn func() request) {
 	r := fn()
 	if _, ok := requestTypes[r.Kind()]; ok {
@@ -60,23 +63,10 @@ func wrapRequest(id int, r request) (*Envelope, error) {
 	}, nil
 }
 
-func writeRequest(w io.Writer, id int, r request) error {
-	b, err := json.Marshal(r)
-	if err != nil {
-		return fmt.Errorf("unable to marshal request: %v", err)
-	}
-	msg := json.RawMessage(b)
-	e := &Envelope{
-		Id:   id,
-		Kind: r.Kind(),
-		Body: msg,
-	}
-	raw, err := json.Marshal(e)
+func writeRequest(c codec, id int, r request) error {
+	e, err := wrapRequest(id, r)
 	if err != nil {
-		return fmt.Errorf("unable to marshal request envelope: %v", err)
-	}
-	if _, err := w.Write(raw); err != nil {
-		return fmt.Errorf("unable to write request: %v", err)
+		return err
 	}
-	return nil
+	return c.writeEnvelope(e)
 }
@@ -5,8 +5,11 @@ import (
 	"crypto/rsa"
 	"reflect"
 	"testing"
+	"time"
 )
 
+var testTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
 var requests = []request{
 	&Message{
 		Key:  []byte("hmm maybe this should be checked."),
@@ -14,14 +17,17 @@ var requests = []request{
 		To:   "alice",
 		Text: []byte("this is my great message"),
 	},
-	&ListMessages{N: 10},
+	&ListMessages{N: 10, Since: testTime},
 	&ListMessagesResponse{
-		{0, []byte("key"), []byte("from")},
-		{1, []byte("key"), []byte("from")},
-		{2, []byte("key"), []byte("from")},
-		{3, []byte("key"), []byte("from")},
+		{Id: 0, Key: []byte("key"), From: []byte("from"), Received: testTime, Sender: "bob", MessageFlags: MessageFlags{Starred: true}},
+		{Id: 1, Key: []byte("key"), From: []byte("from")},
+		{Id: 2, Key: []byte("key"), From: []byte("from"), Received: testTime, Sender: "bob"},
+		{Id: 3, Key: []byte("key"), From: []byte("from")},
 	},
 	&GetMessage{Id: 8},
+	&SetMessageFlag{Id: 8, Flag: "archived", On: true},
+	&CountMessages{},
+	&MessageCounts{"total": 7, "unread": 2, "starred": 1, "archived": 3},
 	&GetNoteRequest{Id: 12},
 	&EncryptedNote{
 		Key:   []byte("this is not a key"),
@@ -30,10 +36,50 @@ var requests = []request{
 	},
 	&ListNotes{N: 10},
 	&ListNotesResponse{
-		{0, []byte("key"), []byte("title")},
-		{1, []byte("key"), []byte("title")},
-		{2, []byte("key"), []byte("title")},
-		{3, []byte("key"), []byte("title")},
+		{Id: 0, Key: []byte("key"), Title: []byte("title"), Received: testTime},
+		{Id: 1, Key: []byte("key"), Title: []byte("title")},
+		{Id: 2, Key: []byte("key"), Title: []byte("title"), Received: testTime},
+		{Id: 3, Key: []byte("key"), Title: []byte("title")},
+	},
+	&Hello{
+		Version:    2,
+		MinVersion: 2,
+		Kinds:      []string{"auth", "hello"},
+		Ciphers:    []string{"rsa-pkcs1v15+aes-128-cbc"},
+	},
+	&AuthChallenge{Nonce: []byte("encrypted nonce")},
+	&AuthProof{Nonce: []byte("nonce")},
+	&ContactUpdate{Nick: "mallory", Op: "block"},
+	&ListContacts{},
+	&ListContactsResponse{
+		Contacts:     []string{"alice", "bob"},
+		Blocked:      []string{"mallory"},
+		ContactsOnly: true,
+	},
+	&InboxPolicy{ContactsOnly: true},
+	&Presence{Nick: "alice", Status: "away"},
+	&SetPresence{Status: "online"},
+	&PresencePrivacy{Hidden: true},
+	&SubscribePresence{Nicks: []string{"alice", "bob"}},
+	&PresenceList{{"alice", "online"}, {"bob", "offline"}},
+	&Ping{},
+	&Pong{},
+	&StoreBlob{Name: "addressbook", Blob: EncryptedBlob{[]byte("key"), []byte("data")}},
+	&GetBlob{Name: "addressbook"},
+	&BlobResponse{Name: "addressbook", Found: true, Blob: EncryptedBlob{[]byte("key"), []byte("data")}},
+	&UsageRequest{},
+	&ExportUser{Nick: "alice"},
+	&ImportUser{OnConflict: "merge", Archive: Archive{Version: 1, Nick: "alice", PublicKey: []byte(`{"N":1,"E":3}`)}},
+	&Archive{
+		Version:   1,
+		Nick:      "alice",
+		PublicKey: []byte(`{"N":1,"E":3}`),
+		Notes:     []ArchiveItem{{Id: 0, Item: []byte(`{"Title":"t"}`)}},
+		Meta:      []ArchiveEntry{{Key: "contacts/bob", Value: []byte{}}},
+	},
+	&UsageResponse{
+		{"alice", 2048, 3},
+		{"bob", 0, 0},
 	},
 }
 
@@ -53,9 +99,15 @@ func TestEnvelope(t *testing.T) {
 		})
 	}
 
-	e := ErrorDoc("this is my error document.")
+	e := ErrorDoc{Message: "this is my error document."}
 	requests = append(requests, &e)
 
+	coded := errorf(codeQuotaExceeded, "storage quota of %d items exceeded", 10)
+	requests = append(requests, &coded)
+
+	limited := throttled(1500*time.Millisecond, "too many messages to %s", "bob")
+	requests = append(requests, &limited)
+
 	r := KeyRequest("bob")
 	requests = append(requests, &r)
 
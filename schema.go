@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notes and messages are stored as records: the item itself, tagged with the
+// format it was written in, so that the structs on the wire can change
+// without losing the ability to read what's already on disk.  Each user
+// database also carries a schema version.  When a database is opened, every
+// registered migration newer than its schema is run over it, in order, and
+// the new schema is written along with the migrated records in one batch.
+
+// schemaKey holds a user database's schema version.  Databases written
+// before there were schema versions don't have one, and are at schema 0.
+const schemaKey = "schema"
+
+// record formats.  A change to EncryptedNote or Message that older servers
+// couldn't read gets a new format, and a migration to rewrite the old ones.
+const (
+	noteFormat    = "note/1"
+	messageFormat = "message/1"
+)
+
+// a record is a stored note or message.  Alongside the item, the server
+// notes when it was received and who sent it, as they authenticated.
+// Records written before that have a zero Received and no Sender.  Messages
+// also carry their flags.
+type record struct {
+	Format   string
+	Received time.Time
+	Sender   string `json:",omitempty"`
+	MessageFlags
+	Data json.RawMessage
+}
+
+// encodeRecord makes a record of an item received just now from sender.
+func encodeRecord(format, sender string, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(record{Format: format, Received: time.Now().UTC(), Sender: sender, Data: data})
+}
+
+// decodeRecord reads a record, which must be in the given format, into v.
+// The record is returned for its metadata.
+func decodeRecord(val []byte, format string, v interface{}) (*record, error) {
+	var r record
+	if err := json.Unmarshal(val, &r); err != nil {
+		return nil, fmt.Errorf("unable to parse record: %v", err)
+	}
+	if r.Format != format {
+		return nil, fmt.Errorf("record has format %q, expected %q", r.Format, format)
+	}
+	if err := json.Unmarshal(r.Data, v); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// a migration moves a user database from the schema before it to its
+// version.  Its record func is called on every value under its prefixes,
+// and returns the value's replacement, or nil to leave it alone.
+type migration struct {
+	version  int
+	name     string
+	prefixes []string
+	record   func(key string, val []byte) ([]byte, error)
+}
+
+var migrations []migration
+
+// registerMigration adds a migration.  Migrations must be registered in
+// version order, with no gaps.
+func registerMigration(m migration) {
+	if m.version != len(migrations)+1 {
+		panic(fmt.Sprintf("migration %q has version %d, expected %d", m.name, m.version, len(migrations)+1))
+	}
+	migrations = append(migrations, m)
+}
+
+// schemaVersion is the schema written by this server.
+func schemaVersion() int {
+	return len(migrations)
+}
+
+func init() {
+	registerMigration(migration{
+		version:  1,
+		name:     "tag notes and messages with their record format",
+		prefixes: []string{"notes/", "messages/"},
+		record:   tagRecord,
+	})
+	registerMigration(migration{
+		version:  2,
+		name:     "mark existing messages read",
+		prefixes: []string{"messages/"},
+		record:   markLegacyRead,
+	})
+}
+
+// tagRecord wraps an untagged note or message in a record.
+func tagRecord(key string, val []byte) ([]byte, error) {
+	var r record
+	if err := json.Unmarshal(val, &r); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", key, err)
+	}
+	if r.Format != "" {
+		return nil, nil
+	}
+	format := messageFormat
+	if strings.HasPrefix(key, "notes/") {
+		format = noteFormat
+	}
+	return json.Marshal(record{Format: format, Data: val})
+}
+
+// a migrationReport says what migrating a database did, or would do.
+type migrationReport struct {
+	From, To int
+	Changed  map[string]int // records changed by each migration, by name
+}
+
+func (r *migrationReport) String() string {
+	if r.From == r.To {
+		return fmt.Sprintf("schema %d is current", r.To)
+	}
+	names := make([]string, 0, len(r.Changed))
+	for name := range r.Changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s: %d records", name, r.Changed[name]))
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("schema %d to %d", r.From, r.To)
+	}
+	return fmt.Sprintf("schema %d to %d (%s)", r.From, r.To, strings.Join(parts, "; "))
+}
+
+func (db *userdb) schema() (int, error) {
+	val, err := db.Get([]byte(schemaKey))
+	switch err {
+	case nil:
+		return decodeInt(string(val))
+	case errNotFound:
+		return 0, nil
+	default:
+		return 0, err
+	}
+}
+
+// migrate brings a database up to the current schema.  With dryRun, nothing
+// is written, but the report says what would have changed.
+func (db *userdb) migrate(dryRun bool) (*migrationReport, error) {
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+
+	from, err := db.schema()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read schema version: %v", err)
+	}
+	report := &migrationReport{From: from, To: schemaVersion(), Changed: make(map[string]int)}
+	if from > report.To {
+		return nil, fmt.Errorf("database has schema %d, but this server only knows up to %d", from, report.To)
+	}
+	if from == report.To {
+		return report, nil
+	}
+
+	// later migrations see the records as earlier ones left them.
+	changed := make(map[string][]byte)
+	var order []string
+	for _, m := range migrations[from:] {
+		for _, prefix := range m.prefixes {
+			it := db.NewIterator([]byte(prefix))
+			for it.Next() {
+				key := string(it.Key())
+				val, ok := changed[key]
+				if !ok {
+					val = it.Value()
+				}
+				out, err := m.record(key, val)
+				if err != nil {
+					it.Release()
+					return nil, fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+				}
+				if out == nil {
+					continue
+				}
+				if _, ok := changed[key]; !ok {
+					order = append(order, key)
+				}
+				changed[key] = out
+				report.Changed[m.name]++
+			}
+			it.Release()
+			if err := it.Error(); err != nil {
+				return nil, fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+			}
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	var b batch
+	for _, key := range order {
+		b.Put([]byte(key), changed[key])
+	}
+	b.Put([]byte(schemaKey), []byte(encodeInt(report.To)))
+	if err := db.Write(&b); err != nil {
+		return nil, fmt.Errorf("unable to write migrated records: %v", err)
+	}
+	// records may have changed size, so have the quota counters recounted.
+	db.usageLock.Lock()
+	db.usage = nil
+	db.usageLock.Unlock()
+	return report, nil
+}
+
+// migrateItems brings archived notes or messages, written at schema from, up
+// to the current schema.
+func migrateItems(prefix string, items []ArchiveItem, from int) error {
+	if from > schemaVersion() {
+		return fmt.Errorf("archive has schema %d, but this server only knows up to %d", from, schemaVersion())
+	}
+	for _, m := range migrations[from:] {
+		if !hasAnyPrefix(prefix, m.prefixes) {
+			continue
+		}
+		for i, item := range items {
+			out, err := m.record(prefix+encodeInt(item.Id), item.Item)
+			if err != nil {
+				return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+			}
+			if out != nil {
+				items[i].Item = out
+			}
+		}
+	}
+	return nil
+}
+
+// upgradeDatabases migrates every user database, offline.  With -dry-run it
+// only reports what would change.
+func upgradeDatabases() {
+	if err := setupStorage(); err != nil {
+		exit(1, "%v", err)
+	}
+	nicks, err := listStoreUsers()
+	if err != nil {
+		exit(1, "%v", err)
+	}
+	defer closeShared()
+
+	failed := 0
+	for _, nick := range nicks {
+		db, err := openUserDB(nick, false)
+		if err != nil {
+			error_log.Printf("unable to open database for %s: %v", nick, err)
+			failed++
+			continue
+		}
+		report, err := db.migrate(options.dryRun)
+		db.Close()
+		if err != nil {
+			error_log.Printf("unable to upgrade %s: %v", nick, err)
+			failed++
+			continue
+		}
+		if options.dryRun && report.From != report.To {
+			info_log.Printf("%s: %v (dry run, nothing written)", nick, report)
+		} else {
+			info_log.Printf("%s: %v", nick, report)
+		}
+	}
+	if failed > 0 {
+		exit(1, "%d of %d databases were not upgraded", failed, len(nicks))
+	}
+}
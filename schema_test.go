@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	memoryUsers(t, "schema-test", "schema-copy")
+
+	// a database as written before there were schema versions.
+	legacy, err := openUserDB("schema-test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Put([]byte("public_key"), []byte(`{"N":1,"E":3}`))
+	legacy.Put([]byte("notes/"+encodeInt(0)), []byte(`{"Key":"a2V5","Title":"dA==","Body":"Yg=="}`))
+	legacy.Put([]byte("messages/"+encodeInt(0)), []byte(`{"Key":"a2V5","From":"Ym9i","To":"schema-test","Text":"aGk="}`))
+
+	report, err := legacy.migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.From != 0 || report.To != schemaVersion() || report.Changed[migrations[0].name] != 2 {
+		t.Errorf("expected a dry run to report 2 records tagged, saw %v", report)
+	}
+	if schema, _ := legacy.schema(); schema != 0 {
+		t.Errorf("a dry run changed the schema to %d", schema)
+	}
+
+	db, err := getUserDB("schema-test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema, _ := db.schema(); schema != schemaVersion() {
+		t.Errorf("expected opening the database to migrate it to schema %d, saw %d", schemaVersion(), schema)
+	}
+	var note EncryptedNote
+	val, _ := db.Get([]byte("notes/" + encodeInt(0)))
+	if _, err := decodeRecord(val, noteFormat, &note); err != nil || string(note.Title) != "t" {
+		t.Errorf("unable to read migrated note: %v %+v", err, note)
+	}
+	var msg Message
+	val, _ = db.Get([]byte("messages/" + encodeInt(0)))
+	rec, err := decodeRecord(val, messageFormat, &msg)
+	if err != nil || msg.To != "schema-test" {
+		t.Errorf("unable to read migrated message: %v %+v", err, msg)
+	} else if !rec.Read {
+		t.Errorf("expected an existing message to be marked read, saw %+v", rec.MessageFlags)
+	}
+	if report, err := db.migrate(false); err != nil || len(report.Changed) != 0 {
+		t.Errorf("expected a current database to be left alone, saw %v %v", report, err)
+	}
+	if _, err := decodeRecord(val, noteFormat, &note); err == nil {
+		t.Errorf("a message was read as a note")
+	}
+
+	// archives from before schema versions are migrated as they're imported.
+	a := &Archive{
+		Version:   1,
+		Nick:      "schema-copy",
+		PublicKey: []byte(`{"N":1,"E":3}`),
+		Notes:     []ArchiveItem{{Id: 0, Item: []byte(`{"Title":"dA=="}`)}},
+	}
+	if _, err := importArchive(a, "fail"); err != nil {
+		t.Fatal(err)
+	}
+	imported, _ := getUserDB("schema-copy", false)
+	val, _ = imported.Get([]byte("notes/" + encodeInt(0)))
+	if _, err := decodeRecord(val, noteFormat, &note); err != nil {
+		t.Errorf("imported note wasn't migrated: %v", err)
+	}
+	if schema, _ := imported.schema(); schema != schemaVersion() {
+		t.Errorf("expected an import to be at schema %d, saw %d", schemaVersion(), schema)
+	}
+}
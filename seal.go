@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Messages and notes are end-to-end encrypted, but everything around them
+// isn't: who a message is addressed to, who's on a contact list, the user's
+// public key.  Given a master key, the server seals its user databases so
+// that none of that can be read off the disk.
+//
+// Every value is sealed with AES-GCM, using the value's key as additional
+// data so that values can't be moved between keys.  Keys are split after
+// their last slash; the part before it, like "contacts/", is left alone so
+// that prefix iteration still works, and the rest is sealed with a
+// deterministic cipher so that it can still be looked up.  The ids under
+// orderedPrefixes are left alone too, since messages and notes are listed in
+// id order.  That means the number of messages and notes, and the names of
+// the databases themselves, can still be seen.
+
+// orderedPrefixes are the prefixes whose keys are read in order.
+var orderedPrefixes = []string{"messages/", "notes/"}
+
+// masterKeyEnv is the environment variable holding the master key when
+// -master-key isn't given.
+const masterKeyEnv = "WHISPER_MASTER_KEY"
+
+// masterSealer seals the user databases, or is nil if there's no master key.
+var masterSealer *sealer
+
+// readMasterKey reads a base64 encoded 32 byte master key from a file, or
+// from the environment if path is empty.  It returns nil if there's no key.
+func readMasterKey(path string) ([]byte, error) {
+	var text string
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read master key: %v", err)
+		}
+		text = string(b)
+	} else {
+		text = os.Getenv(masterKeyEnv)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, not %d", len(key))
+	}
+	return key, nil
+}
+
+// loadMasterKey sets up masterSealer from -master-key or the environment.
+func loadMasterKey() error {
+	key, err := readMasterKey(options.masterKey)
+	if err != nil || key == nil {
+		return err
+	}
+	masterSealer, err = newSealer(key)
+	if err != nil {
+		return err
+	}
+	info_log.Printf("user databases are sealed with the master key")
+	return nil
+}
+
+// generateMasterKey prints a new random master key.
+func generateMasterKey() {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		exit(1, "couldn't generate master key: %v", err)
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+}
+
+// a sealer holds the keys derived from a master key.
+type sealer struct {
+	values cipher.AEAD
+	names  cipher.Block
+	mac    []byte
+}
+
+func deriveKey(master []byte, label string) []byte {
+	h := hmac.New(sha256.New, master)
+	h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+func newSealer(master []byte) (*sealer, error) {
+	vb, err := aes.NewCipher(deriveKey(master, "whisper values"))
+	if err != nil {
+		return nil, err
+	}
+	values, err := cipher.NewGCM(vb)
+	if err != nil {
+		return nil, err
+	}
+	names, err := aes.NewCipher(deriveKey(master, "whisper names"))
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{values: values, names: names, mac: deriveKey(master, "whisper name mac")}, nil
+}
+
+// sealName encrypts a name deterministically: the iv is a mac of the name,
+// which is checked again when the name is opened.  The result is base64, so
+// it never contains a slash.
+func (s *sealer) sealName(name []byte) []byte {
+	h := hmac.New(sha256.New, s.mac)
+	h.Write(name)
+	iv := h.Sum(nil)[:aes.BlockSize]
+
+	out := make([]byte, aes.BlockSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(s.names, iv).XORKeyStream(out[aes.BlockSize:], name)
+	return []byte(base64.RawURLEncoding.EncodeToString(out))
+}
+
+func (s *sealer) openName(sealed []byte) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(string(sealed))
+	if err != nil || len(raw) < aes.BlockSize {
+		return nil, fmt.Errorf("key %q is not sealed", sealed)
+	}
+	iv := raw[:aes.BlockSize]
+	name := make([]byte, len(raw)-aes.BlockSize)
+	cipher.NewCTR(s.names, iv).XORKeyStream(name, raw[aes.BlockSize:])
+
+	h := hmac.New(sha256.New, s.mac)
+	h.Write(name)
+	if !hmac.Equal(h.Sum(nil)[:aes.BlockSize], iv) {
+		return nil, fmt.Errorf("unable to open key %q: wrong master key?", sealed)
+	}
+	return name, nil
+}
+
+func splitKey(key []byte) (prefix, rest []byte) {
+	i := bytes.LastIndexByte(key, '/')
+	return key[:i+1], key[i+1:]
+}
+
+func ordered(prefix []byte) bool {
+	for _, p := range orderedPrefixes {
+		if string(prefix) == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sealer) sealKey(key []byte) []byte {
+	prefix, rest := splitKey(key)
+	if len(rest) == 0 || ordered(prefix) {
+		return key
+	}
+	return append(append([]byte(nil), prefix...), s.sealName(rest)...)
+}
+
+func (s *sealer) openKey(sealed []byte) ([]byte, error) {
+	prefix, rest := splitKey(sealed)
+	if len(rest) == 0 || ordered(prefix) {
+		return sealed, nil
+	}
+	name, err := s.openName(rest)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), prefix...), name...), nil
+}
+
+func (s *sealer) sealValue(key, value []byte) ([]byte, error) {
+	nonce := make([]byte, s.values.NonceSize(), s.values.NonceSize()+len(value)+s.values.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.values.Seal(nonce, nonce, value, key), nil
+}
+
+func (s *sealer) openValue(key, sealed []byte) ([]byte, error) {
+	n := s.values.NonceSize()
+	if len(sealed) < n {
+		return nil, fmt.Errorf("value of %s is not sealed", key)
+	}
+	val, err := s.values.Open(nil, sealed[:n], sealed[n:], key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open value of %s: wrong master key, or a database that was never sealed?", key)
+	}
+	return val, nil
+}
+
+// sealedStore seals everything written to a store and opens everything read
+// from it.  Prefixes given to NewIterator must end in a slash.
+type sealedStore struct {
+	store
+	sealer *sealer
+}
+
+func (s *sealedStore) Get(key []byte) ([]byte, error) {
+	val, err := s.store.Get(s.sealer.sealKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return s.sealer.openValue(key, val)
+}
+
+func (s *sealedStore) Put(key, value []byte) error {
+	sealed, err := s.sealer.sealValue(key, value)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(s.sealer.sealKey(key), sealed)
+}
+
+func (s *sealedStore) Delete(key []byte) error {
+	return s.store.Delete(s.sealer.sealKey(key))
+}
+
+func (s *sealedStore) Write(b *batch) error {
+	var sb batch
+	for _, op := range b.ops {
+		if op.delete {
+			sb.Delete(s.sealer.sealKey(op.key))
+			continue
+		}
+		sealed, err := s.sealer.sealValue(op.key, op.value)
+		if err != nil {
+			return err
+		}
+		sb.Put(s.sealer.sealKey(op.key), sealed)
+	}
+	return s.store.Write(&sb)
+}
+
+func (s *sealedStore) NewIterator(prefix []byte) iterator {
+	return &sealedIterator{iterator: s.store.NewIterator(prefix), sealer: s.sealer}
+}
+
+// sealedIterator opens keys and values as they're read.  Anything that can't
+// be opened is reported by Error.
+type sealedIterator struct {
+	iterator
+	sealer *sealer
+	err    error
+}
+
+func (it *sealedIterator) Key() []byte {
+	key, err := it.sealer.openKey(it.iterator.Key())
+	if err != nil {
+		it.err = err
+		return nil
+	}
+	return key
+}
+
+func (it *sealedIterator) Value() []byte {
+	key := it.Key()
+	if key == nil {
+		return nil
+	}
+	val, err := it.sealer.openValue(key, it.iterator.Value())
+	if err != nil {
+		it.err = err
+		return nil
+	}
+	return val
+}
+
+func (it *sealedIterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.iterator.Error()
+}
+
+// rotateMasterKey re-seals every user database, offline, from the key in
+// -master-key (or the environment) to the key in -new-master-key.  Either
+// may be missing: with no old key, plain databases are sealed for the first
+// time; with no new key, sealed databases are opened back up.  Each user's
+// database is rewritten in a single batch, so an interrupted rotation leaves
+// every database entirely under one key or the other.
+func rotateMasterKey() {
+	oldKey, err := readMasterKey(options.masterKey)
+	if err != nil {
+		exit(1, "%v", err)
+	}
+	// the new key only ever comes from a file; an empty path doesn't mean the
+	// environment here.
+	var newKey []byte
+	if options.newMasterKey != "" {
+		if newKey, err = readMasterKey(options.newMasterKey); err != nil {
+			exit(1, "%v", err)
+		}
+		if newKey == nil {
+			exit(1, "no key in %s", options.newMasterKey)
+		}
+	}
+	var from, to *sealer
+	if oldKey != nil {
+		if from, err = newSealer(oldKey); err != nil {
+			exit(1, "%v", err)
+		}
+	}
+	if newKey != nil {
+		if to, err = newSealer(newKey); err != nil {
+			exit(1, "%v", err)
+		}
+	}
+	if from == nil && to == nil {
+		exit(1, "nothing to do: give the current key with -master-key or %s, and the new one with -new-master-key", masterKeyEnv)
+	}
+
+	nicks, err := listStoreUsers()
+	if err != nil {
+		exit(1, "%v", err)
+	}
+	defer closeShared()
+
+	failed := 0
+	for _, nick := range nicks {
+		n, err := reseal(nick, from, to)
+		if err != nil {
+			error_log.Printf("unable to rotate key for %s: %v", nick, err)
+			failed++
+			continue
+		}
+		info_log.Printf("rotated key for %s: %d keys", nick, n)
+	}
+	if failed > 0 {
+		exit(1, "%d of %d databases were not rotated", failed, len(nicks))
+	}
+}
+
+// reseal rewrites one user's database from one sealer to another.  A nil
+// sealer means the database is, or is to be, unsealed.
+func reseal(nick string, from, to *sealer) (int, error) {
+	s, err := openUserStore(nick, false)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	it := s.NewIterator(nil)
+	defer it.Release()
+
+	var b batch
+	n := 0
+	for it.Next() {
+		rawKey, rawVal := copyBytes(it.Key()), it.Value()
+		key, val := rawKey, copyBytes(rawVal)
+		if from != nil {
+			if key, err = from.openKey(rawKey); err != nil {
+				return 0, err
+			}
+			if val, err = from.openValue(key, rawVal); err != nil {
+				return 0, err
+			}
+		}
+		if to != nil {
+			newVal, err := to.sealValue(key, val)
+			if err != nil {
+				return 0, err
+			}
+			key, val = to.sealKey(key), newVal
+		}
+		b.Delete(rawKey)
+		b.Put(key, val)
+		n++
+	}
+	if err := it.Error(); err != nil {
+		return 0, err
+	}
+	return n, s.Write(&b)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealedStore(t *testing.T) {
+	memoryUsers(t, "seal-test")
+
+	first, _ := newSealer(bytes.Repeat([]byte{1}, 32))
+	second, _ := newSealer(bytes.Repeat([]byte{2}, 32))
+
+	raw, err := openUserStore("seal-test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, "sealed", &sealedStore{store: raw, sealer: first})
+
+	s := &sealedStore{store: raw, sealer: first}
+	s.Put([]byte("contacts/bob"), nil)
+	s.Put([]byte("public_key"), []byte("secret key"))
+	it := raw.NewIterator(nil)
+	for it.Next() {
+		if bytes.Contains(it.Key(), []byte("bob")) || bytes.Contains(it.Key(), []byte("public_key")) {
+			t.Errorf("key %q was stored in the clear", it.Key())
+		}
+		if bytes.Contains(it.Value(), []byte("secret")) {
+			t.Errorf("value of %q was stored in the clear", it.Key())
+		}
+	}
+	it.Release()
+
+	if _, err := (&sealedStore{store: raw, sealer: second}).Get([]byte("public_key")); err == nil {
+		t.Errorf("opened a value with the wrong key")
+	}
+
+	for _, step := range []struct{ from, to *sealer }{{first, second}, {second, nil}, {nil, first}} {
+		if _, err := reseal("seal-test", step.from, step.to); err != nil {
+			t.Fatalf("unable to reseal: %v", err)
+		}
+		var s store = raw
+		if step.to != nil {
+			s = &sealedStore{store: raw, sealer: step.to}
+		}
+		if v, err := s.Get([]byte("public_key")); err != nil || string(v) != "secret key" {
+			t.Errorf("expected secret key after resealing, saw %q (%v)", v, err)
+		}
+		if _, err := s.Get([]byte("contacts/bob")); err != nil {
+			t.Errorf("expected contacts/bob after resealing, saw %v", err)
+		}
+	}
+}
@@ -1,164 +1,386 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	"io"
 	"net"
+	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
-func stream(r io.Reader, c chan Envelope, e chan error, done chan interface{}) {
+// stream reads envelopes from a codec until the stream ends.  Bad frames are
+// reported on the error channel and skipped; any other error is reported and
+// ends the stream.  Once quit is closed, nothing is reading the channels any
+// more, so the stream gives up instead of blocking on them.
+func stream(c codec, out chan Envelope, e chan error, done chan interface{}, quit chan struct{}) {
 	defer close(done)
-	decoder := json.NewDecoder(r)
-	var env Envelope
 	for {
-		err := decoder.Decode(&env)
-		switch err {
-		case io.EOF:
-			return
+		env, err := c.readEnvelope()
+		switch err.(type) {
 		case nil:
-			c <- env
+			select {
+			case out <- *env:
+			case <-quit:
+				return
+			}
+		case frameError:
+			select {
+			case e <- err:
+			case <-quit:
+				return
+			}
 		default:
-			e <- err
+			if err != io.EOF {
+				select {
+				case e <- err:
+				case <-quit:
+				}
+			}
+			return
 		}
 	}
 }
 
 type serverConnection struct {
-	conn net.Conn
-	nick string
-	key  *rsa.PublicKey
-	db   *userdb
+	conn      transport
+	codec     codec
+	nick      string
+	key       *rsa.PublicKey
+	db        *userdb
+	limit     *bucket
+	challenge *authChallenge
+	peer      *peerInfo
+	quit      chan struct{} // closed when the server is shutting down
+
+	// guards watching, which is read by other connections when they
+	// publish their presence
+	mu       sync.Mutex
+	watching map[string]bool
+
+	// serializes writes, since presence updates are pushed from other
+	// connections' goroutines
+	wlock sync.Mutex
 }
 
 func (s *serverConnection) sendResponse(id int, r request) error {
-	return writeRequest(s.conn, id, r)
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	// a client that has stopped reading would otherwise block this write,
+	// and every writer queued behind it, forever.
+	if options.idleTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(options.idleTimeout))
+	}
+	return writeRequest(s.codec, id, r)
 }
 
-func (s *serverConnection) handleRequest(request Envelope) error {
-	info_log.Printf("handle request #%d", request.Id)
-	switch request.Kind {
+func (s *serverConnection) handleRequest(env Envelope) (request, error) {
+	info_log.Printf("handle request #%d", env.Id)
+	if err := s.throttle(env); err != nil {
+		return nil, err
+	}
+	if err := checkEnvelope(env); err != nil {
+		return nil, err
+	}
+	if s.nick == "" && actsAsCaller(env.Kind) {
+		return nil, errorf(codeUnauthenticated, "request %s requires authentication", env.Kind)
+	}
+	switch env.Kind {
+	case "hello":
+		return s.handleHello(env.Body)
 	case "auth":
-		return s.handleAuthRequest(request.Id, request.Body)
+		return s.handleAuthRequest(env.Body)
+	case "auth-proof":
+		return s.handleAuthProof(env.Body)
 	case "note":
-		return s.handleNoteRequest(request.Id, request.Body)
+		return s.handleNoteRequest(env.Body)
 	case "get-note":
-		return s.handleGetNoteRequest(request.Id, request.Body)
+		return s.handleGetNoteRequest(env.Body)
 	case "list-notes-request":
-		return s.handleListNotesRequest(request.Id, request.Body)
+		return s.handleListNotesRequest(env.Body)
 	case "get-key":
-		return s.handleKeyRequest(request.Id, request.Body)
+		return s.handleKeyRequest(env.Body)
 	case "send-message":
-		return s.handleMessageRequest(request.Id, request.Body)
+		return s.handleMessageRequest(env.Body)
 	case "get-message":
-		return s.handleGetMessageRequest(request.Id, request.Body)
+		return s.handleGetMessageRequest(env.Body)
 	case "list-messages":
-		return s.handleListMessagesRequest(request.Id, request.Body)
+		return s.handleListMessagesRequest(env.Body)
+	case "set-message-flag":
+		return s.handleSetMessageFlag(env.Body)
+	case "count-messages":
+		return s.handleCountMessages(env.Body)
+	case "usage-report":
+		return s.handleUsageRequest(env.Body)
+	case "export-user":
+		return s.handleExportUser(env.Body)
+	case "import-user":
+		return s.handleImportUser(env.Body)
+	case "update-contact":
+		return s.handleContactUpdate(env.Body)
+	case "list-contacts":
+		return s.handleListContacts(env.Body)
+	case "set-inbox-policy":
+		return s.handleInboxPolicy(env.Body)
+	case "set-presence":
+		return s.handleSetPresence(env.Body)
+	case "set-presence-privacy":
+		return s.handlePresencePrivacy(env.Body)
+	case "subscribe-presence":
+		return s.handleSubscribePresence(env.Body)
+	case "store-blob":
+		return s.handleStoreBlob(env.Body)
+	case "get-blob":
+		return s.handleGetBlob(env.Body)
+	case "ping":
+		return Pong{}, nil
 	default:
-		return fmt.Errorf("no such request type: %v", request.Kind)
+		return nil, errorf(codeUnsupported, "server does not support %s requests (protocol version %d)", env.Kind, protocolVersion)
 	}
 }
 
-func (s *serverConnection) handleAuthRequest(requestId int, body json.RawMessage) error {
+// actsAsCaller reports whether a request reads or writes the caller's own
+// data, or is made in their name, and so can't be handled until the
+// connection has authenticated.  Everything else works on an anonymous
+// connection, as it always has.
+func actsAsCaller(kind string) bool {
+	switch kind {
+	case "send-message", "note", "get-note", "list-notes-request",
+		"get-message", "list-messages", "set-message-flag", "count-messages",
+		"update-contact", "list-contacts", "set-inbox-policy",
+		"set-presence", "set-presence-privacy",
+		"store-blob", "get-blob":
+		return true
+	}
+	return false
+}
+
+// host returns the remote host of the connection, without its port.
+func (s *serverConnection) host() string {
+	addr := s.conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// throttle applies the per-connection, per-nick and per-host rate limits to
+// an incoming request.
+func (s *serverConnection) throttle(request Envelope) error {
+	if wait := s.limit.take(); wait > 0 {
+		return throttled(wait, "too many requests on this connection")
+	}
+	if s.nick != "" {
+		if wait := nickLimits.get(s.nick).take(); wait > 0 {
+			return throttled(wait, "too many requests for %s", s.nick)
+		}
+	}
+	switch request.Kind {
+	case "auth", "get-key":
+		if wait := authFailLimits.get(s.host()).wait(); wait > 0 {
+			return throttled(wait, "too many failed lookups from this host")
+		}
+		if wait := authLimits.get(s.host()).take(); wait > 0 {
+			return throttled(wait, "too many lookups from this host")
+		}
+	}
+	return nil
+}
+
+// authFailed records a failed auth or key lookup against the connection's
+// host, so that repeated guessing of nicks or keys gets locked out.
+func (s *serverConnection) authFailed() {
+	authFailLimits.get(s.host()).drain()
+}
+
+func (s *serverConnection) handleHello(body json.RawMessage) (request, error) {
+	if s.peer != nil {
+		return nil, fmt.Errorf("protocol already negotiated")
+	}
+	var req Hello
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad hello: %v", err)
+	}
+	peer, err := negotiate(&req)
+	if err != nil {
+		return nil, err
+	}
+	s.peer = peer
+	info_log.Printf("negotiated %v with %v", peer, s.conn.RemoteAddr())
+
+	res := newHello()
+	res.Ciphers = peer.ciphers
+	return res, nil
+}
+
+func (s *serverConnection) handleAuthRequest(body json.RawMessage) (request, error) {
+	if s.nick != "" {
+		return nil, fmt.Errorf("already authenticated as %s", s.nick)
+	}
+	if s.peer == nil {
+		return nil, errorf(codeVersionMismatch, "client did not negotiate a protocol version; clients older than protocol version %d must be upgraded", minProtocolVersion)
+	}
 	var auth AuthRequest
 	if err := json.Unmarshal(body, &auth); err != nil {
-		return fmt.Errorf("bad auth request: %v", err)
+		return nil, fmt.Errorf("bad auth request: %v", err)
 	}
-	if auth.Nick == "" {
-		return fmt.Errorf("empty username")
+	nick, err := canonicalNick(auth.Nick)
+	if err != nil {
+		return nil, err
 	}
-	s.nick = auth.Nick
+	auth.Nick = nick
 	if auth.Key == nil {
-		return fmt.Errorf("empty key")
+		return nil, fmt.Errorf("empty key")
 	}
-	s.key = auth.Key
-	if err := s.openDB(); err != nil {
-		return fmt.Errorf("failed to open user database: %v", err)
+	db, err := getUserDB(auth.Nick, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user database: %v", err)
 	}
-	b, err := s.db.Get([]byte("public_key"), nil)
+	newKey := false
+	b, err := db.Get([]byte("public_key"))
 	switch err {
-	case leveldb.ErrNotFound:
-		keybytes, err := json.Marshal(auth.Key)
-		if err != nil {
-			return fmt.Errorf("cannot marshal auth key: %v", err)
-		}
-		if err := s.db.Put([]byte("public_key"), keybytes, nil); err != nil {
-			return fmt.Errorf("cannot write public key to database: %v", err)
-		}
-		info_log.Printf("saved key for user %s", auth.Nick)
+	case errNotFound:
+		newKey = true
 	case nil:
 		var key rsa.PublicKey
 		if err := json.Unmarshal(b, &key); err != nil {
-			return fmt.Errorf("cannot unmarshal auth key from request: %v", err)
+			return nil, fmt.Errorf("cannot unmarshal auth key from request: %v", err)
 		}
-		if auth.Key.E != key.E {
-			return fmt.Errorf("client presented wrong auth key")
-		}
-		if auth.Key.N.Cmp(key.N) != 0 {
-			return fmt.Errorf("client presented wrong auth key")
+		if auth.Key.E != key.E || auth.Key.N.Cmp(key.N) != 0 {
+			s.authFailed()
+			return nil, fmt.Errorf("client presented wrong auth key")
 		}
 	default:
-		return fmt.Errorf("unable to read public key: %v", err)
+		return nil, fmt.Errorf("unable to read public key: %v", err)
 	}
-	info_log.Printf("%s", b)
-	info_log.Printf("authenticated user %s", auth.Nick)
-	s.sendResponse(requestId, Bool(true))
-	return nil
-}
 
-func (s *serverConnection) handleNoteRequest(requestId int, body json.RawMessage) error {
-	r := util.BytesPrefix([]byte("notes/"))
-	it := s.db.NewIterator(r, nil)
-	defer it.Release()
+	// a public key is public, so presenting one proves nothing.  The client
+	// has to show that it holds the matching private key by decrypting a
+	// nonce before the connection is considered authenticated.
+	nonce, err := randslice(32)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create auth challenge: %v", err)
+	}
+	cnonce, err := rsa.EncryptPKCS1v15(rand.Reader, auth.Key, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt auth challenge: %v", err)
+	}
+	s.challenge = &authChallenge{
+		nick:   auth.Nick,
+		key:    auth.Key,
+		db:     db,
+		nonce:  nonce,
+		newKey: newKey,
+	}
+	return AuthChallenge{Nonce: cnonce}, nil
+}
 
-	id := 0
-	if it.Last() {
-		k := it.Key()
-		id_s := strings.TrimPrefix(string(k), "notes/")
-		lastId, err := decodeInt(id_s)
-		if err != nil {
-			return fmt.Errorf("error getting note id: %v", err)
+func (s *serverConnection) handleAuthProof(body json.RawMessage) (request, error) {
+	var proof AuthProof
+	if err := json.Unmarshal(body, &proof); err != nil {
+		return nil, fmt.Errorf("bad auth proof: %v", err)
+	}
+	if s.nick != "" {
+		return nil, fmt.Errorf("already authenticated as %s", s.nick)
+	}
+	c := s.challenge
+	s.challenge = nil
+	if c == nil {
+		return nil, fmt.Errorf("auth proof received without an auth request")
+	}
+	if subtle.ConstantTimeCompare(c.nonce, proof.Nonce) != 1 {
+		s.authFailed()
+		return nil, fmt.Errorf("client failed auth challenge")
+	}
+	if c.newKey {
+		if err := c.db.claimKey(c.key); err != nil {
+			s.authFailed()
+			return nil, err
 		}
-		id = lastId + 1
+		info_log.Printf("saved key for user %s", c.nick)
 	}
-	key := fmt.Sprintf("notes/%s", encodeInt(id))
-	if err := s.db.Put([]byte(key), body, nil); err != nil {
-		return fmt.Errorf("unable to write note to db: %v", err)
+	s.nick, s.key, s.db = c.nick, c.key, c.db
+	addSession(s)
+	info_log.Printf("authenticated user %s", s.nick)
+	return Bool(true), nil
+}
+
+func (s *serverConnection) handleNoteRequest(body json.RawMessage) (request, error) {
+	var note EncryptedNote
+	if err := json.Unmarshal(body, &note); err != nil {
+		return nil, fmt.Errorf("bad note request: %v", err)
+	}
+	if err := checkBody(note.Body); err != nil {
+		return nil, err
+	}
+
+	val, err := encodeRecord(noteFormat, s.nick, note)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode note: %v", err)
+	}
+	key, err := s.db.appendItem("notes/", val)
+	if err != nil {
+		if _, ok := err.(ErrorDoc); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unable to write note to db: %v", err)
 	}
 	info_log.Printf("stored new note at %s", key)
-	return nil
+	return Bool(true), nil
 }
 
-func (s *serverConnection) handleGetNoteRequest(requestId int, body json.RawMessage) error {
+func (s *serverConnection) handleGetNoteRequest(body json.RawMessage) (request, error) {
 	var req GetNoteRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		return fmt.Errorf("bad getnote request: %v", err)
+		return nil, fmt.Errorf("bad getnote request: %v", err)
 	}
 	key := fmt.Sprintf("notes/%s", encodeInt(int(req.Id)))
-	b, err := s.db.Get([]byte(key), nil)
+	b, err := s.db.Get([]byte(key))
 	if err != nil {
-		return fmt.Errorf("couldn't retrieve note: %v", err)
+		return nil, fmt.Errorf("couldn't retrieve note: %v", err)
 	}
 	var note EncryptedNote
-	if err := json.Unmarshal(b, &note); err != nil {
-		return fmt.Errorf("couldn't unmarshal note: %v", err)
+	if _, err := decodeRecord(b, noteFormat, &note); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal note: %v", err)
 	}
-	return s.sendResponse(requestId, note)
+	return note, nil
 }
 
-func (s *serverConnection) handleListNotesRequest(requestId int, body json.RawMessage) error {
-	r := util.BytesPrefix([]byte("notes/"))
+func (s *serverConnection) handleListNotesRequest(body json.RawMessage) (request, error) {
+	var req ListNotes
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, fmt.Errorf("bad list notes request: %v", err)
+		}
+	}
+	if req.N <= 0 {
+		req.N = 10
+	}
+	if req.N > maxListNotes {
+		req.N = maxListNotes
+	}
 
-	it := s.db.NewIterator(r, nil)
+	it := s.db.NewIterator([]byte("notes/"))
 	defer it.Release()
 
-	notes := make(ListNotesResponse, 0, 10)
+	notes := make(ListNotesResponse, 0, req.N)
 	it.Last()
-	for i := 0; it.Valid() && i < 10; i++ {
+	if req.Before > 0 {
+		for it.Valid() {
+			id, err := decodeInt(strings.TrimPrefix(string(it.Key()), "notes/"))
+			if err == nil && id < req.Before {
+				break
+			}
+			it.Prev()
+		}
+	}
+	for i := 0; it.Valid() && i < req.N; i++ {
 		key, val := it.Key(), it.Value()
 
 		info_log.Printf("note %d has key %s", i, string(key))
@@ -173,160 +395,596 @@ func (s *serverConnection) handleListNotesRequest(requestId int, body json.RawMe
 		info_log.Printf("note key: %s id: %d\n", key, id)
 
 		var note EncryptedNote
-		if err := json.Unmarshal(val, &note); err != nil {
+		rec, err := decodeRecord(val, noteFormat, &note)
+		if err != nil {
 			error_log.Printf("unable to unmarshal encrypted note: %v", err)
 			it.Prev()
 			continue
 		}
 		notes = append(notes, ListNotesResponseItem{
-			Id:    id,
-			Key:   note.Key,
-			Title: note.Title,
+			Id:       id,
+			Key:      note.Key,
+			Title:    note.Title,
+			Received: rec.Received,
+			Sender:   rec.Sender,
 		})
 		it.Prev()
 	}
 	if err := it.Error(); err != nil {
-		return fmt.Errorf("error reading listnotes from db: %v", err)
+		return nil, fmt.Errorf("error reading listnotes from db: %v", err)
 	}
-	return s.sendResponse(requestId, notes)
+	return notes, nil
 }
 
-func (s *serverConnection) handleKeyRequest(requestId int, body json.RawMessage) error {
+func (s *serverConnection) handleKeyRequest(body json.RawMessage) (request, error) {
 	var req KeyRequest
 	if err := json.Unmarshal(body, &req); err != nil {
 		error_log.Printf("unable to read key request: %v", err)
-		return err
+		return nil, err
+	}
+	nick, err := canonicalNick(req.Nick())
+	if err != nil {
+		return nil, err
 	}
-	info_log.Printf("get key: %v", req.Nick())
-	key, err := getUserKey(req.Nick())
+	info_log.Printf("get key: %v", nick)
+	key, err := getUserKey(nick)
 	if err != nil {
-		return err
+		error_log.Printf("unable to get key for %s: %v", nick, err)
+		s.authFailed()
+		return nil, fmt.Errorf("no key found for %s", nick)
 	}
 	res := KeyResponse{
-		Nick: req.Nick(),
+		Nick: nick,
 		Key:  *key,
 	}
-	return s.sendResponse(requestId, res)
+	return res, nil
 }
 
-func (s *serverConnection) handleMessageRequest(requestId int, body json.RawMessage) error {
+func (s *serverConnection) handleMessageRequest(body json.RawMessage) (request, error) {
 	var req Message
 	if err := json.Unmarshal(body, &req); err != nil {
 		error_log.Printf("unable to read message request: %v", err)
-		return err
+		return nil, err
+	}
+	if err := checkBody(req.Text); err != nil {
+		return nil, err
+	}
+	to, err := canonicalNick(req.To)
+	if err != nil {
+		return nil, err
+	}
+	req.To = to
+	if wait := pairLimits.get(s.nick + "\x00" + req.To).take(); wait > 0 {
+		return nil, throttled(wait, "too many messages to %s", req.To)
 	}
 
 	db, err := getUserDB(req.To, false)
 	if err != nil {
-		return err
+		error_log.Printf("unable to open db for %s: %v", req.To, err)
+		s.authFailed()
+		return nil, fmt.Errorf("no such user %s", req.To)
+	}
+	if err := db.accepts(s.nick); err != nil {
+		return nil, err
 	}
 
-	k, err := db.nextKey("messages/")
+	val, err := encodeRecord(messageFormat, s.nick, req)
 	if err != nil {
-		return fmt.Errorf("unable to save message: %v", err)
+		return nil, fmt.Errorf("unable to encode message: %v", err)
 	}
-
-	if err := db.Put([]byte(k), body, nil); err != nil {
-		return fmt.Errorf("unable to save message: %v", err)
+	if _, err := db.appendItem("messages/", val); err != nil {
+		if _, ok := err.(ErrorDoc); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unable to save message: %v", err)
 	}
-	return s.sendResponse(requestId, Bool(true))
+	return Bool(true), nil
 }
 
-func (s *serverConnection) handleGetMessageRequest(requestId int, body json.RawMessage) error {
+func (s *serverConnection) handleGetMessageRequest(body json.RawMessage) (request, error) {
 	var req GetMessage
 	if err := json.Unmarshal(body, &req); err != nil {
-		return fmt.Errorf("unable to read getmessage request: %v", err)
+		return nil, fmt.Errorf("unable to read getmessage request: %v", err)
 	}
 
 	key := fmt.Sprintf("messages/%s", encodeInt(req.Id))
-	val, err := s.db.Get([]byte(key), nil)
+	val, err := s.db.Get([]byte(key))
 	if err != nil {
-		return fmt.Errorf("unable to read message: %v", err)
+		return nil, fmt.Errorf("unable to read message: %v", err)
 	}
 
 	var msg Message
-	if err := json.Unmarshal(val, &msg); err != nil {
-		return fmt.Errorf("unable to parse message: %v", err)
+	rec, err := decodeRecord(val, messageFormat, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse message: %v", err)
 	}
-	return s.sendResponse(requestId, msg)
+	if !rec.Read {
+		if _, err := s.db.setMessageFlag(req.Id, flagRead, true); err != nil {
+			error_log.Printf("unable to mark message %d read: %v", req.Id, err)
+		}
+	}
+	return msg, nil
 }
 
-func (s *serverConnection) handleListMessagesRequest(requestId int, body json.RawMessage) error {
+func (s *serverConnection) handleSetMessageFlag(body json.RawMessage) (request, error) {
+	var req SetMessageFlag
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad set message flag request: %v", err)
+	}
+	if !validMessageFlag(req.Flag) {
+		return nil, fmt.Errorf("unknown message flag %q: must be read, archived or starred", req.Flag)
+	}
+	if _, err := s.db.setMessageFlag(req.Id, req.Flag, req.On); err != nil {
+		if err == errNotFound {
+			return nil, fmt.Errorf("no message with id %d", req.Id)
+		}
+		return nil, fmt.Errorf("unable to set message flag: %v", err)
+	}
+	return Bool(true), nil
+}
+
+func (s *serverConnection) handleCountMessages(body json.RawMessage) (request, error) {
+	counts, err := s.db.countMessages()
+	if err != nil {
+		return nil, fmt.Errorf("unable to count messages: %v", err)
+	}
+	return counts, nil
+}
+
+func (s *serverConnection) handleListMessagesRequest(body json.RawMessage) (request, error) {
 	var req ListMessages
 	if err := json.Unmarshal(body, &req); err != nil {
 		error_log.Printf("unable to read message request: %v", err)
-		return err
+		return nil, err
+	}
+
+	if req.N <= 0 {
+		req.N = 10
 	}
+	if req.N > maxListMessages {
+		req.N = maxListMessages
+	}
+
+	// messages merged in from an archive are stored after newer ones, so
+	// every message has to be checked against Since.
+	it := s.db.NewIterator([]byte("messages/"))
+	defer it.Release()
 
-	prefix := []byte("messages/")
 	messages := make(ListMessagesResponse, 0, 10)
-	fn := func(n int, v []byte) error {
+	for ok := it.Last(); ok && len(messages) < req.N; ok = it.Prev() {
+		id, err := decodeInt(strings.TrimPrefix(string(it.Key()), "messages/"))
+		if err != nil {
+			return nil, fmt.Errorf("error handling listmessages request: bad key %s: %v", it.Key(), err)
+		}
 		var msg Message
-		if err := json.Unmarshal(v, &msg); err != nil {
-			return fmt.Errorf("unable to parse message blob: %v", err)
+		rec, err := decodeRecord(it.Value(), messageFormat, &msg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse message blob: %v", err)
+		}
+		if !req.Since.IsZero() && rec.Received.Before(req.Since) {
+			continue
+		}
+		if rec.Archived != req.Archived || (req.Unread && rec.Read) || (req.Starred && !rec.Starred) {
+			continue
 		}
 		messages = append(messages, ListMessagesResponseItem{
-			Id:   n,
-			Key:  msg.Key,
-			From: msg.From,
+			Id:           id,
+			Key:          msg.Key,
+			From:         msg.From,
+			Received:     rec.Received,
+			Sender:       rec.Sender,
+			MessageFlags: rec.MessageFlags,
 		})
-		return nil
 	}
-	if err := s.db.collect(prefix, -10, fn); err != nil {
-		return fmt.Errorf("error handling listmessages request: %v", err)
+	if err := it.Error(); err != nil {
+		return nil, fmt.Errorf("error handling listmessages request: %v", err)
 	}
-	return s.sendResponse(requestId, messages)
+	return messages, nil
 }
 
-func (s *serverConnection) openDB() error {
-	db, err := getUserDB(s.nick, true)
+func (s *serverConnection) handleUsageRequest(body json.RawMessage) (request, error) {
+	if !isAdmin(s.nick) {
+		return nil, errorf(codeForbidden, "usage reports are restricted to admins")
+	}
+	nicks, err := listUsers()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	s.db = db
-	return nil
+	report := make(UsageResponse, 0, len(nicks))
+	for _, nick := range nicks {
+		db, err := getUserDB(nick, false)
+		if err != nil {
+			error_log.Printf("unable to open database for usage report: %v", err)
+			continue
+		}
+		u, err := db.getUsage()
+		if err != nil {
+			error_log.Printf("unable to read usage for %s: %v", nick, err)
+			continue
+		}
+		report = append(report, UsageResponseItem{
+			Nick:  nick,
+			Bytes: u.Bytes,
+			Items: u.Items,
+		})
+	}
+	return report, nil
+}
+
+func (s *serverConnection) handleContactUpdate(body json.RawMessage) (request, error) {
+	var req ContactUpdate
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad contact update: %v", err)
+	}
+	nick, err := canonicalNick(req.Nick)
+	if err != nil {
+		return nil, err
+	}
+	req.Nick = nick
+
+	switch req.Op {
+	case "add":
+		err = s.db.Put([]byte(contactsPrefix+req.Nick), nil)
+	case "remove":
+		err = s.db.Delete([]byte(contactsPrefix + req.Nick))
+	case "block":
+		err = s.db.Put([]byte(blockedPrefix+req.Nick), nil)
+	case "unblock":
+		err = s.db.Delete([]byte(blockedPrefix + req.Nick))
+	default:
+		return nil, fmt.Errorf("unknown contact operation: %s", req.Op)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to update contacts: %v", err)
+	}
+	return Bool(true), nil
+}
+
+func (s *serverConnection) handleListContacts(body json.RawMessage) (request, error) {
+	contacts, err := s.db.listNicks(contactsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	blocked, err := s.db.listNicks(blockedPrefix)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := s.db.inboxPolicy()
+	if err != nil {
+		return nil, err
+	}
+	return ListContactsResponse{
+		Contacts:     contacts,
+		Blocked:      blocked,
+		ContactsOnly: policy.ContactsOnly,
+	}, nil
+}
+
+func (s *serverConnection) handleInboxPolicy(body json.RawMessage) (request, error) {
+	var req InboxPolicy
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad inbox policy request: %v", err)
+	}
+	if err := s.db.Put([]byte(policyKey), body); err != nil {
+		return nil, fmt.Errorf("unable to save inbox policy: %v", err)
+	}
+	return Bool(true), nil
+}
+
+func (s *serverConnection) handleSetPresence(body json.RawMessage) (request, error) {
+	var req SetPresence
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad set presence request: %v", err)
+	}
+	if !validStatus(req.Status) {
+		return nil, fmt.Errorf("unknown status: %s", req.Status)
+	}
+	publishPresence(s.nick, req.Status)
+	return Presence{Nick: s.nick, Status: req.Status}, nil
+}
+
+func (s *serverConnection) handlePresencePrivacy(body json.RawMessage) (request, error) {
+	var req PresencePrivacy
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad presence privacy request: %v", err)
+	}
+	var err error
+	if req.Hidden {
+		err = s.db.Put([]byte(presenceHiddenKey), nil)
+	} else {
+		err = s.db.Delete([]byte(presenceHiddenKey))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to save presence settings: %v", err)
+	}
+	if req.Hidden {
+		hidePresence(s.nick)
+	} else {
+		publishPresence(s.nick, currentStatus(s.nick))
+	}
+	return Bool(true), nil
+}
+
+func (s *serverConnection) handleSubscribePresence(body json.RawMessage) (request, error) {
+	var req SubscribePresence
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad subscribe presence request: %v", err)
+	}
+	if err := checkNicks(req.Nicks); err != nil {
+		return nil, err
+	}
+	s.watch(req.Nicks)
+
+	res := make(PresenceList, 0, len(req.Nicks))
+	for _, nick := range req.Nicks {
+		ok, err := canSeePresence(s.nick, nick)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		res = append(res, Presence{Nick: nick, Status: currentStatus(nick)})
+	}
+	return res, nil
+}
+
+func blobKey(name string) (string, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("bad blob name: %q", name)
+	}
+	return "blobs/" + name, nil
+}
+
+func (s *serverConnection) handleStoreBlob(body json.RawMessage) (request, error) {
+	var req StoreBlob
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad store blob request: %v", err)
+	}
+	key, err := blobKey(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBody(req.Blob.Data); err != nil {
+		return nil, err
+	}
+	val, err := json.Marshal(req.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal blob: %v", err)
+	}
+	if err := s.db.putItem(key, val); err != nil {
+		if _, ok := err.(ErrorDoc); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unable to save blob: %v", err)
+	}
+	return Bool(true), nil
+}
+
+func (s *serverConnection) handleGetBlob(body json.RawMessage) (request, error) {
+	var req GetBlob
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad get blob request: %v", err)
+	}
+	key, err := blobKey(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	res := BlobResponse{Name: req.Name}
+	val, err := s.db.Get([]byte(key))
+	switch err {
+	case nil:
+		if err := json.Unmarshal(val, &res.Blob); err != nil {
+			return nil, fmt.Errorf("unable to parse blob: %v", err)
+		}
+		res.Found = true
+	case errNotFound:
+	default:
+		return nil, fmt.Errorf("unable to read blob: %v", err)
+	}
+	return res, nil
 }
 
+// respond handles a single request and sends its response.  Every request
+// gets exactly one response, so that the client can always settle its promise
+// for it.
+func (s *serverConnection) respond(env Envelope) {
+	res, err := s.handleRequest(env)
+	if err != nil {
+		error_log.Printf("client error: %v", err)
+		res = errorDoc(err)
+	} else if res == nil {
+		res = Bool(true)
+	}
+	if err := s.sendResponse(env.Id, res); err != nil {
+		error_log.Printf("unable to send response: %v", err)
+	}
+}
+
+// work handles requests from the queue until it's closed.  Each connection
+// runs options.workers of these, so a slow request doesn't hold up the ones
+// behind it; responses may go out in a different order than their requests
+// came in.
+func (s *serverConnection) work(queue chan Envelope, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for env := range queue {
+		s.respond(env)
+	}
+}
+
+// run serves requests on a connection whose codec has already been set up,
+// until the connection ends.
 func (s *serverConnection) run() {
+	if !addConn(s) {
+		s.conn.Close()
+		return
+	}
+	var wg sync.WaitGroup
+	queue := make(chan Envelope, options.workers)
+	draining := false
 	defer func() {
+		close(queue)
+		if draining {
+			// let the workers finish what they've started, within reason.
+			drained := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(drained)
+			}()
+			select {
+			case <-drained:
+			case <-time.After(options.shutdownTimeout):
+				error_log.Printf("requests from %v still running at shutdown", s.conn.RemoteAddr())
+			}
+		}
+		// closing the connection unblocks any worker stuck writing to it.
 		s.conn.Close()
+		wg.Wait()
+		if s.nick != "" {
+			removeSession(s)
+		}
+		removeConn(s)
 		info_log.Printf("connection ended: %v", s.conn.RemoteAddr())
 	}()
-	info_log.Printf("connection start: %v", s.conn.RemoteAddr())
+	for i := 0; i < options.workers; i++ {
+		wg.Add(1)
+		go s.work(queue, &wg)
+	}
 	requests := make(chan Envelope)
 	errors := make(chan error)
 	done := make(chan interface{})
-	go stream(s.conn, requests, errors, done)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go stream(s.codec, requests, errors, done, stopped)
+	ticker := heartbeatTicker()
+	defer ticker.Stop()
+	last := time.Now()
 	for {
 		select {
-		case request := <-requests:
-			if err := s.handleRequest(request); err != nil {
-				error_log.Printf("client error: %v", err)
-				s.sendResponse(request.Id, ErrorDoc(err.Error()))
+		case <-ticker.C:
+			ping, dead := heartbeat(time.Since(last))
+			if dead {
+				error_log.Printf("closing stale connection from %v: nothing received for %v", s.conn.RemoteAddr(), time.Since(last))
+				return
+			}
+			if ping && s.peer.supports(Ping{}.Kind()) {
+				if err := s.sendResponse(pushId, Ping{}); err != nil {
+					error_log.Printf("unable to send ping: %v", err)
+				}
 			}
+		case env := <-requests:
+			last = time.Now()
+			if env.Id == pushId {
+				// the client's answer to one of our pings; it gets no
+				// response.
+				if env.Kind != (Pong{}).Kind() {
+					error_log.Printf("client pushed unexpected %s", env.Kind)
+				}
+				continue
+			}
+			// the handshake changes the connection's state, which the
+			// workers read without locking, so until it's done every
+			// request is handled here, one at a time.  After that nothing
+			// changes the nick, key, db or peer, since none of them can be
+			// negotiated twice.
+			if s.nick == "" {
+				s.respond(env)
+				continue
+			}
+			// when every worker is busy and the queue is full, this blocks,
+			// and we stop reading from the client until a worker frees up.
+			queue <- env
 		case err := <-errors:
+			last = time.Now()
 			error_log.Printf("connection error: %v", err)
 		case <-done:
 			return
+		case <-s.quit:
+			if s.peer.supports(ServerShutdown{}.Kind()) {
+				if err := s.sendResponse(pushId, ServerShutdown{Reason: "server is shutting down"}); err != nil {
+					error_log.Printf("unable to send shutdown notice: %v", err)
+				}
+			}
+			draining = true
+			return
 		}
 	}
 }
 
 func serve() {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", options.port))
+	if options.workers < 1 {
+		exit(1, "workers must be at least 1, not %d", options.workers)
+	}
+	if err := setupStorage(); err != nil {
+		exit(1, "%v", err)
+	}
+	legacy, err := legacyStores()
 	if err != nil {
-		exit(1, "couldn't open tcp port for listening: %v", err)
+		exit(1, "%v", err)
+	}
+	if len(legacy) > 0 {
+		exit(1, "found databases made by an older server in %s (%s); run whisper migrate to rename them before starting the server", options.dataDir, strings.Join(legacy, ", "))
+	}
+	if !options.tcp && options.socket == "" {
+		exit(1, "nothing to listen on: tcp is disabled and no socket was given")
+	}
+	var listeners []net.Listener
+	if options.tcp {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", options.port))
+		if err != nil {
+			exit(1, "couldn't open tcp port for listening: %v", err)
+		}
+		info_log.Printf("server listening: %s:%d", options.host, options.port)
+		listeners = append(listeners, l)
 	}
-	info_log.Printf("server listening: %s:%d", options.host, options.port)
+	if options.socket != "" {
+		l, err := listenUnix(options.socket, os.FileMode(options.socketMode))
+		if err != nil {
+			exit(1, "couldn't open unix socket for listening: %v", err)
+		}
+		info_log.Printf("server listening: %s (mode %v)", options.socket, &options.socketMode)
+		listeners = append(listeners, l)
+	}
+	if options.wsPort > 0 {
+		go serveWebSocket()
+	}
+	if options.httpPort > 0 {
+		go serveGateway()
+	}
+	for _, l := range listeners {
+		addListener(l)
+		go acceptLoop(l)
+	}
+	waitForSignals()
+}
+
+func acceptLoop(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if shuttingDown() {
+				return
+			}
 			error_log.Printf("error accepting new connection: %v", err)
 			continue
 		}
-		srvConn := serverConnection{
-			conn: conn,
-		}
-		go srvConn.run()
+		go acceptConn(conn)
+	}
+}
+
+// acceptConn serves a new tcp or unix socket connection.
+func acceptConn(conn net.Conn) {
+	info_log.Printf("connection start: %v", conn.RemoteAddr())
+	c, err := acceptCodec(conn)
+	if err != nil {
+		error_log.Printf("connection error: %v", err)
+		conn.Close()
+		return
+	}
+	s := serverConnection{
+		conn:  conn,
+		codec: c,
+		limit: newBucket(&options.connLimit),
 	}
+	s.run()
 }
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// With -layout shared, every user is kept in a single store named sharedName
+// instead of a store each.  A user's keys are namespaced under
+// "user\x00<nick>\x00", and each user also has an empty "nick\x00<nick>" key
+// so that users can be listed without scanning everything.  The userdb sees
+// only its own namespace, so nothing above this file can tell the two layouts
+// apart.
+
+const sharedName = "_shared"
+
+var (
+	sharedStore store
+	sharedLock  sync.Mutex
+)
+
+func userPrefix(nick string) []byte {
+	return []byte("user\x00" + nick + "\x00")
+}
+
+func nickKey(nick string) []byte {
+	return []byte("nick\x00" + nick)
+}
+
+// openShared opens the shared store, if it isn't open already.
+func openShared() (store, error) {
+	sharedLock.Lock()
+	defer sharedLock.Unlock()
+
+	if sharedStore != nil {
+		return sharedStore, nil
+	}
+	b, err := storageBackend()
+	if err != nil {
+		return nil, err
+	}
+	s, err := b.open(sharedName, true)
+	if err != nil {
+		return nil, err
+	}
+	sharedStore = s
+	return s, nil
+}
+
+func closeShared() {
+	sharedLock.Lock()
+	defer sharedLock.Unlock()
+
+	if sharedStore == nil {
+		return
+	}
+	if err := sharedStore.Close(); err != nil {
+		error_log.Printf("unable to close shared database: %v", err)
+	}
+	sharedStore = nil
+}
+
+// openUserStore opens a user's store in whichever layout is configured.
+func openUserStore(nick string, create bool) (store, error) {
+	if options.layout != "shared" {
+		b, err := storageBackend()
+		if err != nil {
+			return nil, err
+		}
+		return b.open(storeName(nick), create)
+	}
+
+	shared, err := openShared()
+	if err != nil {
+		return nil, err
+	}
+	_, err = shared.Get(nickKey(nick))
+	switch err {
+	case nil:
+	case errNotFound:
+		if !create {
+			return nil, fmt.Errorf("no database for %s", nick)
+		}
+		if err := shared.Put(nickKey(nick), nil); err != nil {
+			return nil, fmt.Errorf("unable to create database for %s: %v", nick, err)
+		}
+		info_log.Printf("created shared database namespace for %s", nick)
+	default:
+		return nil, fmt.Errorf("unable to open database for %s: %v", nick, err)
+	}
+	return &prefixStore{store: shared, prefix: userPrefix(nick)}, nil
+}
+
+// listStoreUsers lists every user with a store in whichever layout is
+// configured.
+func listStoreUsers() ([]string, error) {
+	if options.layout != "shared" {
+		b, err := storageBackend()
+		if err != nil {
+			return nil, err
+		}
+		names, err := b.list()
+		if err != nil {
+			return nil, err
+		}
+		nicks := make([]string, 0, len(names))
+		for _, name := range names {
+			if nick, ok := storeNick(name); ok {
+				nicks = append(nicks, nick)
+			}
+		}
+		return nicks, nil
+	}
+
+	shared, err := openShared()
+	if err != nil {
+		return nil, err
+	}
+	prefix := []byte("nick\x00")
+	it := shared.NewIterator(prefix)
+	defer it.Release()
+
+	nicks := make([]string, 0, 32)
+	for it.Next() {
+		nicks = append(nicks, string(bytes.TrimPrefix(it.Key(), prefix)))
+	}
+	if err := it.Error(); err != nil {
+		return nil, fmt.Errorf("unable to list users: %v", err)
+	}
+	return nicks, nil
+}
+
+// prefixStore is one user's namespace in the shared store.
+type prefixStore struct {
+	store
+	prefix []byte
+}
+
+func (p *prefixStore) key(k []byte) []byte {
+	return append(append(make([]byte, 0, len(p.prefix)+len(k)), p.prefix...), k...)
+}
+
+func (p *prefixStore) Get(key []byte) ([]byte, error) {
+	return p.store.Get(p.key(key))
+}
+
+func (p *prefixStore) Put(key, value []byte) error {
+	return p.store.Put(p.key(key), value)
+}
+
+func (p *prefixStore) Delete(key []byte) error {
+	return p.store.Delete(p.key(key))
+}
+
+func (p *prefixStore) NewIterator(prefix []byte) iterator {
+	return &prefixIterator{iterator: p.store.NewIterator(p.key(prefix)), prefix: p.prefix}
+}
+
+func (p *prefixStore) Write(b *batch) error {
+	var pb batch
+	for _, op := range b.ops {
+		pb.ops = append(pb.ops, batchOp{key: p.key(op.key), value: op.value, delete: op.delete})
+	}
+	return p.store.Write(&pb)
+}
+
+// Close leaves the shared store open; it's closed by closeDBs.
+func (p *prefixStore) Close() error {
+	return nil
+}
+
+type prefixIterator struct {
+	iterator
+	prefix []byte
+}
+
+func (it *prefixIterator) Key() []byte {
+	return bytes.TrimPrefix(it.iterator.Key(), it.prefix)
+}
+
+// migrate brings the per-user leveldb databases in the data directory up to
+// date.  With the per-user layout it renames databases named by older servers,
+// which used the nick itself as the name.  With the shared layout it copies
+// every per-user database into the shared store, leaving users that are
+// already there alone.  Old databases are never removed.
+func migrate() {
+	names, err := listFiles(".db")()
+	if err != nil {
+		exit(1, "%v", err)
+	}
+	var shared store
+	switch options.layout {
+	case "per-user":
+		b, err := storageBackend()
+		if err != nil {
+			exit(1, "%v", err)
+		}
+		if b.ext == "" {
+			exit(1, "migrate can't rename databases with -storage %s", options.storage)
+		}
+		if names, err = b.list(); err != nil {
+			exit(1, "%v", err)
+		}
+	case "shared":
+		shared, err = openShared()
+		if err != nil {
+			exit(1, "unable to open shared database: %v", err)
+		}
+		defer closeShared()
+	default:
+		exit(1, "unknown layout %q: must be per-user or shared", options.layout)
+	}
+
+	failed := 0
+	for _, name := range names {
+		if name == sharedName {
+			continue
+		}
+		nick, ok := storeNick(name)
+		if ok && shared == nil {
+			continue
+		}
+		if !ok && shared == nil {
+			if err := renameLegacy(name); err != nil {
+				error_log.Printf("unable to migrate %s: %v", name, err)
+				failed++
+			}
+			continue
+		}
+		if !ok {
+			if nick, err = legacyNick(name); err != nil {
+				error_log.Printf("unable to migrate %s: %v", name, err)
+				failed++
+				continue
+			}
+		}
+		n, err := migrateUser(shared, name, nick)
+		if err != nil {
+			error_log.Printf("unable to migrate %s: %v", nick, err)
+			failed++
+			continue
+		}
+		if n >= 0 {
+			info_log.Printf("migrated %s: %d keys", nick, n)
+		}
+	}
+	if failed > 0 {
+		exit(1, "%d of %d databases were not migrated", failed, len(names))
+	}
+}
+
+// renameLegacy gives a database named after its nick the name storeName would
+// give it.
+func renameLegacy(name string) error {
+	nick, err := legacyNick(name)
+	if err != nil {
+		return err
+	}
+	b, err := storageBackend()
+	if err != nil {
+		return err
+	}
+	from := filepath.Join(options.dataDir, name+b.ext)
+	to := filepath.Join(options.dataDir, storeName(nick)+b.ext)
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("%s already has a database at %s", nick, to)
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	info_log.Printf("renamed %s to %s", from, to)
+	return nil
+}
+
+// legacyStores lists the per-user databases that are still named after their
+// nick, as older servers named them.  The server doesn't look for those, so
+// until they're renamed by migrate their users would find themselves with new,
+// empty databases.
+func legacyStores() ([]string, error) {
+	if options.layout != "per-user" {
+		return nil, nil
+	}
+	b, err := storageBackend()
+	if err != nil {
+		return nil, err
+	}
+	names, err := b.list()
+	if err != nil {
+		return nil, err
+	}
+	var legacy []string
+	for _, name := range names {
+		if _, ok := storeNick(name); !ok && name != sharedName {
+			legacy = append(legacy, name)
+		}
+	}
+	return legacy, nil
+}
+
+// migrateUser copies one user's database, the leveldb store with the given
+// name, into the shared store.  It returns the number of keys copied, or -1
+// if the user was already there.  The user's nick key is written last, so a
+// user whose import was interrupted isn't visible and is imported again from
+// the start on the next run.
+func migrateUser(shared store, name, nick string) (int, error) {
+	switch _, err := shared.Get(nickKey(nick)); err {
+	case nil:
+		info_log.Printf("%s is already in the shared database, skipping", nick)
+		return -1, nil
+	case errNotFound:
+	default:
+		return 0, err
+	}
+
+	src, err := openLevelDB(name, false)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst := &prefixStore{store: shared, prefix: userPrefix(nick)}
+
+	it := src.NewIterator(nil)
+	defer it.Release()
+
+	n := 0
+	var b batch
+	for it.Next() {
+		b.Put(copyBytes(it.Key()), copyBytes(it.Value()))
+		n++
+		if len(b.ops) == 1000 {
+			if err := dst.Write(&b); err != nil {
+				return n, err
+			}
+			b = batch{}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return n, err
+	}
+	if err := dst.Write(&b); err != nil {
+		return n, err
+	}
+	return n, shared.Put(nickKey(nick), nil)
+}
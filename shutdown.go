@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ServerShutdown is pushed to every client when the server is going away.
+// The server stops reading requests from the connection, finishes the ones
+// it has already started, and then closes the connection.
+type ServerShutdown struct {
+	Reason string
+}
+
+func (s ServerShutdown) Kind() string {
+	return "server-shutdown"
+}
+
+func init() { registerRequestType(func() request { return new(ServerShutdown) }) }
+
+// running tracks everything the server has to stop when it shuts down.
+var running = struct {
+	sync.Mutex
+	closing   bool
+	listeners []net.Listener
+	servers   []*http.Server
+	conns     map[*serverConnection]bool
+	wg        sync.WaitGroup
+}{
+	conns: make(map[*serverConnection]bool, 32),
+}
+
+func addListener(l net.Listener) {
+	running.Lock()
+	defer running.Unlock()
+	running.listeners = append(running.listeners, l)
+}
+
+func addHTTPServer(srv *http.Server) {
+	running.Lock()
+	defer running.Unlock()
+	running.servers = append(running.servers, srv)
+}
+
+// addConn registers a connection, so that it's told about a shutdown.  It
+// returns false if the server is already shutting down, in which case the
+// connection shouldn't be served.
+func addConn(s *serverConnection) bool {
+	running.Lock()
+	defer running.Unlock()
+	if running.closing {
+		return false
+	}
+	s.quit = make(chan struct{})
+	running.conns[s] = true
+	running.wg.Add(1)
+	return true
+}
+
+func removeConn(s *serverConnection) {
+	running.Lock()
+	delete(running.conns, s)
+	running.Unlock()
+	running.wg.Done()
+}
+
+func shuttingDown() bool {
+	running.Lock()
+	defer running.Unlock()
+	return running.closing
+}
+
+// waitForSignals blocks until the server is told to stop, reloading the
+// config file on every SIGHUP in the meantime.
+func waitForSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			info_log.Printf("received %v, reloading config", sig)
+			if err := reloadConfig(); err != nil {
+				error_log.Printf("unable to reload config: %v", err)
+			}
+			continue
+		}
+		info_log.Printf("received %v, shutting down", sig)
+		signal.Stop(sigs)
+		shutdown()
+		return
+	}
+}
+
+// shutdown stops accepting connections, tells every client that the server
+// is going away, gives in-flight requests until options.shutdownTimeout to
+// finish, and closes every database once they have.
+func shutdown() {
+	running.Lock()
+	running.closing = true
+	for _, l := range running.listeners {
+		l.Close()
+	}
+	conns := make([]*serverConnection, 0, len(running.conns))
+	for s := range running.conns {
+		conns = append(conns, s)
+	}
+	servers := running.servers
+	running.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), options.shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		// websocket connections are hijacked, so Shutdown doesn't wait for
+		// them; they're drained along with the rest below.
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				error_log.Printf("unable to shut down http server: %v", err)
+			}
+		}(srv)
+	}
+	for _, s := range conns {
+		close(s.quit)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		running.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		info_log.Printf("all connections closed")
+		closeDBs()
+	case <-time.After(options.shutdownTimeout + time.Second):
+		// requests are still running, and closing the databases out from
+		// under them would be worse than leaving them for the os to close.
+		error_log.Printf("gave up waiting for connections to close; leaving databases open")
+	}
+}
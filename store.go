@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errNotFound is returned by store.Get when a key doesn't exist.
+var errNotFound = errors.New("not found")
+
+// a store is the key-value storage behind a userdb.  Keys are kept in
+// byte-wise order.
+type store interface {
+	// Get returns errNotFound for a missing key.  The caller may keep the
+	// returned slice.
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+
+	// NewIterator iterates over every key with the given prefix, or every
+	// key if prefix is nil.  The iterator sees the store as it was when the
+	// iterator was made, regardless of later writes.  It must be released.
+	NewIterator(prefix []byte) iterator
+
+	// Write applies every operation in a batch, or none of them.
+	Write(b *batch) error
+	Close() error
+}
+
+// an iterator walks the keys of a store in order.  It starts out positioned
+// before the first key; Next and Prev on a fresh iterator act like First and
+// Last.  Key and Value are only valid until the iterator moves.
+type iterator interface {
+	First() bool
+	Last() bool
+	Next() bool
+	Prev() bool
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Release()
+}
+
+type batchOp struct {
+	key, value []byte
+	delete     bool
+}
+
+// a batch is a set of writes to apply atomically.
+type batch struct {
+	ops []batchOp
+}
+
+func (b *batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+func (b *batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// a backend knows how to find and open the stores of one storage engine.
+// Stores are named after the user they belong to, or after sharedName when
+// every user is kept in a single store.
+type backend struct {
+	// open opens a named store, creating it if create is set.
+	open func(name string, create bool) (store, error)
+	// list returns the name of every store.
+	list func() ([]string, error)
+	// ext is the extension of the file or directory in the data directory
+	// that each store is kept in, if they're kept on disk.
+	ext string
+}
+
+// backends are the storage engines that can be chosen with -storage.
+var backends = map[string]backend{
+	"leveldb": {open: openLevelDB, list: listFiles(".db"), ext: ".db"},
+	"bolt":    {open: openBolt, list: listFiles(".bolt"), ext: ".bolt"},
+	"memory":  {open: openMemStore, list: listMemStores},
+}
+
+func storageBackend() (backend, error) {
+	b, ok := backends[options.storage]
+	if !ok {
+		names := make([]string, 0, len(backends))
+		for name := range backends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return backend{}, fmt.Errorf("unknown storage backend %q: must be one of %s", options.storage, strings.Join(names, ", "))
+	}
+	return b, nil
+}
+
+// setupStorage checks the storage settings and gets the data directory and
+// master key ready.  It's called before any user database is opened.
+func setupStorage() error {
+	if _, err := storageBackend(); err != nil {
+		return err
+	}
+	if options.layout != "per-user" && options.layout != "shared" {
+		return fmt.Errorf("unknown layout %q: must be per-user or shared", options.layout)
+	}
+	if err := os.MkdirAll(options.dataDir, 0700); err != nil {
+		return fmt.Errorf("unable to create data directory: %v", err)
+	}
+	return loadMasterKey()
+}
+
+// listFiles lists the stores kept as a file or directory with the given
+// extension in the data directory.
+func listFiles(ext string) func() ([]string, error) {
+	return func() ([]string, error) {
+		paths, err := filepath.Glob(filepath.Join(options.dataDir, "*"+ext))
+		if err != nil {
+			return nil, fmt.Errorf("unable to list databases: %v", err)
+		}
+		names := make([]string, 0, len(paths))
+		for _, path := range paths {
+			names = append(names, strings.TrimSuffix(filepath.Base(path), ext))
+		}
+		return names, nil
+	}
+}
+
+// levelStore is a store kept in a leveldb database.
+type levelStore struct {
+	db *leveldb.DB
+}
+
+func openLevelDB(name string, create bool) (store, error) {
+	path := filepath.Join(options.dataDir, name+".db")
+	db, err := leveldb.OpenFile(path, &opt.Options{ErrorIfMissing: !create})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open db file at %s: %v", path, err)
+	}
+	info_log.Printf("opened database file: %s", path)
+	return &levelStore{db: db}, nil
+}
+
+func (l *levelStore) Get(key []byte) ([]byte, error) {
+	val, err := l.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, errNotFound
+	}
+	return val, err
+}
+
+func (l *levelStore) Put(key, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+func (l *levelStore) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+func (l *levelStore) NewIterator(prefix []byte) iterator {
+	var r *util.Range
+	if prefix != nil {
+		r = util.BytesPrefix(prefix)
+	}
+	return l.db.NewIterator(r, nil)
+}
+
+func (l *levelStore) Write(b *batch) error {
+	var lb leveldb.Batch
+	for _, op := range b.ops {
+		if op.delete {
+			lb.Delete(op.key)
+		} else {
+			lb.Put(op.key, op.value)
+		}
+	}
+	return l.db.Write(&lb, nil)
+}
+
+func (l *levelStore) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// TestStores runs the same operations against every storage backend.
+func TestStores(t *testing.T) {
+	info_log, error_log = log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "whisper-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer func() {
+		memStores.Lock()
+		delete(memStores.stores, "store-test")
+		memStores.Unlock()
+	}()
+
+	for name, b := range backends {
+		if _, err := b.open("store-test", false); err == nil {
+			t.Errorf("%s: opened a store that doesn't exist", name)
+		}
+		s, err := b.open("store-test", true)
+		if err != nil {
+			t.Errorf("%s: unable to create store: %v", name, err)
+			continue
+		}
+		testStore(t, name, s)
+		if err := s.Close(); err != nil {
+			t.Errorf("%s: unable to close store: %v", name, err)
+		}
+		// other tests may leave stores of their own in memory, so only
+		// look for ours.
+		nicks, err := b.list()
+		found := false
+		for _, nick := range nicks {
+			found = found || nick == "store-test"
+		}
+		if err != nil || !found {
+			t.Errorf("%s: expected to list store-test, saw %v (%v)", name, nicks, err)
+		}
+	}
+}
+
+func testStore(t *testing.T, name string, s store) {
+	if _, err := s.Get([]byte("missing")); err != errNotFound {
+		t.Errorf("%s: expected errNotFound for a missing key, saw %v", name, err)
+	}
+	if err := s.Put([]byte("flag"), nil); err != nil {
+		t.Fatalf("%s: unable to put: %v", name, err)
+	}
+	if _, err := s.Get([]byte("flag")); err != nil {
+		t.Errorf("%s: key with an empty value should exist, saw %v", name, err)
+	}
+
+	var b batch
+	for _, k := range []string{"notes/b", "notes/a", "notes/c", "other"} {
+		b.Put([]byte(k), []byte("v-"+k))
+	}
+	b.Delete([]byte("flag"))
+	if err := s.Write(&b); err != nil {
+		t.Fatalf("%s: unable to write batch: %v", name, err)
+	}
+	if _, err := s.Get([]byte("flag")); err != errNotFound {
+		t.Errorf("%s: batch should have deleted flag, saw %v", name, err)
+	}
+	if v, err := s.Get([]byte("notes/b")); err != nil || string(v) != "v-notes/b" {
+		t.Errorf("%s: expected v-notes/b, saw %q (%v)", name, v, err)
+	}
+
+	it := s.NewIterator([]byte("notes/"))
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if !it.Last() || string(it.Key()) != "notes/c" {
+		t.Errorf("%s: expected last key notes/c, saw %q", name, it.Key())
+	}
+	if !it.Prev() || string(it.Value()) != "v-notes/b" {
+		t.Errorf("%s: expected previous value v-notes/b, saw %q", name, it.Value())
+	}
+	it.Release()
+	if len(keys) != 3 || keys[0] != "notes/a" || keys[1] != "notes/b" || keys[2] != "notes/c" {
+		t.Errorf("%s: expected notes/a, notes/b, notes/c in order, saw %v", name, keys)
+	}
+
+	if err := s.Delete([]byte("notes/a")); err != nil {
+		t.Errorf("%s: unable to delete: %v", name, err)
+	}
+	it = s.NewIterator(nil)
+	n := 0
+	for it.Next() {
+		n++
+	}
+	it.Release()
+	if n != 3 {
+		t.Errorf("%s: expected 3 keys after delete, saw %d", name, n)
+	}
+}
+
+// TestSharedLayout checks that users in the shared store can't see each
+// other's keys, and that migrating a per-user database keeps its contents.
+func TestSharedLayout(t *testing.T) {
+	info_log, error_log = log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "whisper-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	old, err := openLevelDB("carol", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Put([]byte("notes/0"), []byte("old note"))
+	old.Close()
+
+	defer func(layout string) { options.layout = layout }(options.layout)
+	options.layout = "shared"
+	defer closeShared()
+
+	shared, err := openShared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := migrateUser(shared, "carol", "carol"); err != nil || n != 1 {
+		t.Fatalf("expected to migrate 1 key, saw %d (%v)", n, err)
+	}
+	if n, _ := migrateUser(shared, "carol", "carol"); n != -1 {
+		t.Errorf("expected carol to be skipped the second time, saw %d", n)
+	}
+
+	if _, err := openUserStore("dave", false); err == nil {
+		t.Errorf("opened a user that doesn't exist")
+	}
+	dave, err := openUserStore("dave", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, "shared", dave)
+
+	carol, err := openUserStore("carol", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := carol.Get([]byte("notes/0")); err != nil || string(v) != "old note" {
+		t.Errorf("expected migrated note, saw %q (%v)", v, err)
+	}
+	it := carol.NewIterator(nil)
+	n := 0
+	for it.Next() {
+		n++
+	}
+	it.Release()
+	if n != 1 {
+		t.Errorf("expected carol to see only carol's key, saw %d keys", n)
+	}
+
+	nicks, err := listStoreUsers()
+	if err != nil || len(nicks) != 2 || nicks[0] != "carol" || nicks[1] != "dave" {
+		t.Errorf("expected carol and dave, saw %v (%v)", nicks, err)
+	}
+}
+
+// TestLegacyStores checks that databases named by older servers are found,
+// and can be renamed, with every backend that keeps them on disk.
+func TestLegacyStores(t *testing.T) {
+	info_log, error_log = log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "whisper-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer func(storage, layout string) { options.storage, options.layout = storage, layout }(options.storage, options.layout)
+	options.layout = "per-user"
+
+	for _, storage := range []string{"leveldb", "bolt"} {
+		options.storage = storage
+		b := backends[storage]
+		for _, name := range []string{"alice", storeName("bob")} {
+			s, err := b.open(name, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+		}
+
+		legacy, err := legacyStores()
+		if err != nil || len(legacy) != 1 || legacy[0] != "alice" {
+			t.Errorf("%s: expected alice's database to be found, saw %v (%v)", storage, legacy, err)
+		}
+		if err := renameLegacy("alice"); err != nil {
+			t.Errorf("%s: unable to rename: %v", storage, err)
+		}
+		if legacy, err := legacyStores(); err != nil || len(legacy) != 0 {
+			t.Errorf("%s: expected no legacy databases after renaming, saw %v (%v)", storage, legacy, err)
+		}
+	}
+}
+
+// memoryUsers switches the server to in-memory storage for the rest of the
+// test, with the logs silenced, and forgets the given users' databases once
+// it's over so that nothing is left behind for the next test, or the next run.
+func memoryUsers(t *testing.T, nicks ...string) {
+	info_log, error_log = log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0)
+	storage := options.storage
+	options.storage = "memory"
+	t.Cleanup(func() {
+		options.storage = storage
+		dbopenlock.Lock()
+		defer dbopenlock.Unlock()
+		memStores.Lock()
+		defer memStores.Unlock()
+		for _, nick := range nicks {
+			delete(openDBs, nick)
+			delete(memStores.stores, storeName(nick))
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// fileMode is a flag.Value for a unix permission mode, given in octal.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *fileMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("bad file mode %q: must be octal, like 0660", s)
+	}
+	if v&^0777 != 0 {
+		return fmt.Errorf("bad file mode %q: only permission bits may be set", s)
+	}
+	*m = fileMode(v)
+	return nil
+}
+
+// listenUnix listens on a unix socket at path.  Access to the socket is
+// controlled by its file permissions, which are set to mode.  A socket left
+// behind by a process that has since exited is removed; one that's still
+// being served is not.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already being served", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket %s: %v", path, err)
+		}
+	}
+
+	// the socket is created with its permissions already set by the umask,
+	// so there's no moment where anyone else can connect to it.
+	umask := syscall.Umask(0777 &^ int(mode.Perm()))
+	l, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// unixSocketPath returns the path of a unix socket given to the client as its
+// host, like unix:/var/run/whisper.sock, and whether it is one.
+func unixSocketPath(host string) (string, bool) {
+	if !strings.HasPrefix(host, "unix:") {
+		return "", false
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(host, "unix:"), "//"), true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whisper-unix-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.sock")
+	l, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected socket mode 0600, saw %#o", fi.Mode().Perm())
+	}
+}
+
+func TestPrivateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whisper-unix-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "private")
+	if err := privateDir(private); err != nil {
+		t.Errorf("unable to create a private dir: %v", err)
+	}
+	if err := privateDir(private); err != nil {
+		t.Errorf("a private dir we made ourselves was refused: %v", err)
+	}
+
+	open := filepath.Join(dir, "open")
+	if err := os.Mkdir(open, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(open, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(open); err == nil {
+		t.Errorf("a dir anyone can write to was accepted")
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(private, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(link); err == nil {
+		t.Errorf("a symlink was accepted")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+)
+
+// wsCodec carries envelopes over a websocket, one envelope per text message.
+// Websockets do their own framing, so there's no header or length prefix.
+type wsCodec struct {
+	conn *websocket.Conn
+	max  int
+}
+
+func newWSCodec(conn *websocket.Conn) *wsCodec {
+	if options.maxFrame > 0 {
+		conn.SetReadLimit(int64(options.maxFrame))
+	}
+	return &wsCodec{conn: conn, max: options.maxFrame}
+}
+
+func (w *wsCodec) readEnvelope() (*Envelope, error) {
+	_, raw, err := w.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, frameError{err}
+	}
+	return &env, nil
+}
+
+func (w *wsCodec) writeEnvelope(e *Envelope) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("unable to marshal request envelope: %v", err)
+	}
+	if w.max > 0 && len(raw) > w.max {
+		return fmt.Errorf("envelope of %d bytes exceeds maximum frame size of %d bytes", len(raw), w.max)
+	}
+	if err := w.conn.WriteMessage(websocket.TextMessage, raw); err != nil {
+		return fmt.Errorf("unable to write request: %v", err)
+	}
+	return nil
+}
+
+var upgrader = websocket.Upgrader{
+	// clients authenticate with their keys, not with anything the browser
+	// attaches to the request, so there's nothing for a cross-origin page
+	// to ride on.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveWebSocket accepts websocket connections on options.wsPath.
+func serveWebSocket() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(options.wsPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has already written an http error
+			error_log.Printf("websocket upgrade failed from %s: %v", r.RemoteAddr, err)
+			return
+		}
+		info_log.Printf("websocket connection start: %v", conn.RemoteAddr())
+		s := serverConnection{
+			conn:  conn,
+			codec: newWSCodec(conn),
+			limit: newBucket(&options.connLimit),
+		}
+		s.run()
+	})
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", options.wsPort), Handler: mux}
+	addHTTPServer(srv)
+	info_log.Printf("server listening for websockets: %s:%d%s", options.host, options.wsPort, options.wsPath)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		exit(1, "couldn't serve websockets: %v", err)
+	}
+}
+
+// isWebSocketURL reports whether a host given to the client is actually a
+// websocket url.
+func isWebSocketURL(host string) bool {
+	return strings.HasPrefix(host, "ws://") || strings.HasPrefix(host, "wss://")
+}
+
+// dialWebSocket connects the client to a ws:// or wss:// url.
+func dialWebSocket(url string) (*websocket.Conn, codec, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, newWSCodec(conn), nil
+}
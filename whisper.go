@@ -6,6 +6,7 @@ import (
 	"log"
 	// "net"
 	"os"
+	"time"
 )
 
 const keyLength = 2048
@@ -16,12 +17,52 @@ var (
 )
 
 var options struct {
-	port      int
-	host      string
-	key       string
-	publicKey string
-	nick      string
-	debug     bool
+	port        int
+	host        string
+	key         string
+	publicKey   string
+	nick        string
+	debug       bool
+	maxEnvelope int
+	maxBody     int
+	quotaBytes  int64
+	quotaItems  int
+	admins      string
+	book        string
+	framing     string
+	maxFrame    int
+	legacyJSON  bool
+
+	reconnectMin     time.Duration
+	reconnectMax     time.Duration
+	requestTimeout   time.Duration
+	heartbeat        time.Duration
+	idleTimeout      time.Duration
+	handshakeTimeout time.Duration
+	workers          int
+	wsPort           int
+	wsPath           string
+	httpPort         int
+	tcp              bool
+	socket           string
+	socketMode       fileMode
+	agent            string
+	config           string
+	storage          string
+	layout           string
+	dataDir          string
+	masterKey        string
+	newMasterKey     string
+	onConflict       string
+	dryRun           bool
+
+	shutdownTimeout time.Duration
+
+	connLimit     rateLimit
+	nickLimit     rateLimit
+	pairLimit     rateLimit
+	authLimit     rateLimit
+	authFailLimit rateLimit
 }
 
 func exit(status int, template string, args ...interface{}) {
@@ -47,16 +88,50 @@ func main() {
 	}
 
 	switch flag.Arg(0) {
-	case "client":
+	case "client", "dial":
 		connect()
-	case "server":
+	case "server", "listen":
+		if err := loadConfig(); err != nil {
+			exit(1, "%v", err)
+		}
 		serve()
+	case "migrate":
+		if err := loadConfig(); err != nil {
+			exit(1, "%v", err)
+		}
+		migrate()
+	case "export":
+		if err := loadConfig(); err != nil {
+			exit(1, "%v", err)
+		}
+		exportUser()
+	case "import":
+		if err := loadConfig(); err != nil {
+			exit(1, "%v", err)
+		}
+		importUser()
+	case "upgrade":
+		if err := loadConfig(); err != nil {
+			exit(1, "%v", err)
+		}
+		upgradeDatabases()
+	case "rotate-key":
+		if err := loadConfig(); err != nil {
+			exit(1, "%v", err)
+		}
+		rotateMasterKey()
+	case "generate-master-key":
+		generateMasterKey()
+	case "agent":
+		runAgent()
 	case "generate":
 		generate()
 	case "encrypt":
 		encrypt()
 	case "decrypt":
 		decrypt()
+	case "sign":
+		sign()
 	case "get-public":
 		getPublic()
 	default:
@@ -66,9 +141,53 @@ func main() {
 
 func init() {
 	flag.IntVar(&options.port, "port", 9000, "port number")
-	flag.StringVar(&options.host, "host", "localhost", "host to connect to")
+	flag.StringVar(&options.host, "host", "localhost", "host to connect to, a ws:// or wss:// url, or a unix:/path/to/socket")
 	flag.StringVar(&options.key, "key", "whisper_key", "rsa key to use")
 	flag.StringVar(&options.publicKey, "public-key", "", "public rsa key to use")
 	flag.StringVar(&options.nick, "nick", "", "nick to use in chat")
 	flag.BoolVar(&options.debug, "debug", false, "include debug messages")
+	flag.StringVar(&options.book, "book", "whisper_book", "encrypted address book file")
+	flag.StringVar(&options.framing, "framing", "framed", "wire framing used by the client: framed or json (legacy)")
+	flag.IntVar(&options.maxFrame, "max-frame", 4<<20, "maximum size in bytes of a single frame on the wire (0 for no limit)")
+	flag.DurationVar(&options.reconnectMin, "reconnect-min", 500*time.Millisecond, "initial delay before the client tries to reconnect")
+	flag.DurationVar(&options.reconnectMax, "reconnect-max", 30*time.Second, "maximum delay between the client's reconnect attempts")
+	flag.DurationVar(&options.requestTimeout, "request-timeout", 30*time.Second, "how long the client waits for a response before giving up on a request (0 waits forever)")
+	flag.DurationVar(&options.heartbeat, "heartbeat", 30*time.Second, "how long a connection may be quiet before a ping is sent (0 disables pings)")
+	flag.DurationVar(&options.idleTimeout, "idle-timeout", 90*time.Second, "how long a connection may go without hearing from its peer before it's closed (0 disables)")
+	flag.DurationVar(&options.handshakeTimeout, "handshake-timeout", 10*time.Second, "how long a new connection has to say which framing it speaks (0 waits forever)")
+	flag.IntVar(&options.wsPort, "ws-port", 0, "port on which the server also accepts websocket connections (0 disables websockets)")
+	flag.StringVar(&options.wsPath, "ws-path", "/whisper", "http path on which the server accepts websocket connections")
+	flag.IntVar(&options.httpPort, "http-port", 0, "port on which the server runs its http gateway (0 disables the gateway)")
+	flag.BoolVar(&options.tcp, "tcp", true, "serve on the tcp port (turn off to serve only on -socket)")
+	flag.StringVar(&options.socket, "socket", "", "path of a unix socket on which the server also listens")
+	options.socketMode = 0600
+	flag.Var(&options.socketMode, "socket-mode", "permissions of the server's unix socket, in octal")
+	flag.StringVar(&options.agent, "agent", os.Getenv("WHISPER_AGENT"), "unix socket of a running whisper agent, to use in place of -key")
+	flag.StringVar(&options.config, "config", "", "server config file, re-read on SIGHUP")
+	flag.StringVar(&options.storage, "storage", "leveldb", "storage backend for user databases: leveldb, bolt or memory")
+	flag.StringVar(&options.dataDir, "data-dir", ".", "directory in which the server keeps its databases")
+	flag.StringVar(&options.masterKey, "master-key", "", "file holding the base64 master key that seals user databases (default $"+masterKeyEnv+")")
+	flag.StringVar(&options.newMasterKey, "new-master-key", "", "file holding the master key that rotate-key seals databases with (none unseals them)")
+	flag.StringVar(&options.onConflict, "on-conflict", "fail", "what import does if the user already exists: fail, merge or replace")
+	flag.BoolVar(&options.dryRun, "dry-run", false, "have upgrade report what it would migrate without writing anything")
+	flag.StringVar(&options.layout, "layout", "per-user", "how user databases are laid out: per-user, one database each, or shared, all in one")
+	flag.DurationVar(&options.shutdownTimeout, "shutdown-timeout", 10*time.Second, "how long the server waits for in-flight requests when shutting down")
+	flag.IntVar(&options.workers, "workers", 4, "number of requests the server handles at once on each connection")
+	flag.BoolVar(&options.legacyJSON, "legacy-json", true, "accept clients using the legacy unframed json protocol")
+	flag.IntVar(&options.maxEnvelope, "max-envelope", 1<<20, "maximum size in bytes of a request body accepted by the server (0 for no limit)")
+	flag.IntVar(&options.maxBody, "max-body", 256<<10, "maximum size in bytes of a stored message or note body (0 for no limit)")
+	flag.Int64Var(&options.quotaBytes, "quota-bytes", 64<<20, "maximum number of bytes stored per user (0 for no limit)")
+	flag.IntVar(&options.quotaItems, "quota-items", 10000, "maximum number of messages and notes stored per user (0 for no limit)")
+	flag.StringVar(&options.admins, "admins", "", "comma-separated list of nicks allowed to run admin commands")
+
+	options.connLimit = rateLimit{Rate: 20, Burst: 40}
+	options.nickLimit = rateLimit{Rate: 20, Burst: 40}
+	options.pairLimit = rateLimit{Rate: 0.5, Burst: 10}
+	options.authLimit = rateLimit{Rate: 1, Burst: 20}
+	options.authFailLimit = rateLimit{Rate: 1.0 / 60, Burst: 5}
+	flag.Var(&options.connLimit, "conn-limit", "requests per second (rate:burst) allowed on a single connection")
+	flag.Var(&options.nickLimit, "nick-limit", "requests per second (rate:burst) allowed for a single nick across all of its connections")
+	flag.Var(&options.pairLimit, "pair-limit", "messages per second (rate:burst) one nick may send to another")
+	flag.Var(&options.authLimit, "auth-limit", "auth and key lookups per second (rate:burst) allowed from a single host")
+	flag.Var(&options.authFailLimit, "auth-fail-limit", "failed auth and key lookups per second (rate:burst) allowed from a single host")
 }